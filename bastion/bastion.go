@@ -12,6 +12,7 @@
 package bastion
 
 import (
+	"bytes"
 	"context"
 	"crypto/ed25519"
 	"crypto/sha256"
@@ -19,13 +20,17 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"strings"
 	"sync"
 	"time"
 
+	"golang.org/x/net/http/httpguts"
 	"golang.org/x/net/http2"
 )
 
@@ -40,6 +45,72 @@ type Config struct {
 	// AllowedBackend may be called concurrently.
 	AllowedBackend func(keyHash [sha256.Size]byte) bool
 
+	// BackendLabel, if not nil, returns a human-readable name for the backend
+	// with the given key hash, which is included in log lines as "label". If
+	// it returns an empty string, the label is omitted.
+	//
+	// BackendLabel may be called concurrently.
+	BackendLabel func(keyHash [sha256.Size]byte) string
+
+	// PerBackendRate, if positive, is the maximum sustained rate of requests
+	// per second forwarded to each backend. Requests in excess are served a
+	// 429 Too Many Requests status, without affecting the backend connection.
+	//
+	// PerBackendBurst is the maximum number of requests allowed in a burst.
+	// If zero, it defaults to PerBackendRate, rounded up.
+	//
+	// Limits are only tracked for connected backends, and reset when they
+	// disconnect. Requests for unknown key hashes are not limited, and fail
+	// with a 502 Bad Gateway status.
+	PerBackendRate  float64
+	PerBackendBurst int
+
+	// AllowBackendConn, if not nil, returns whether a backend connection from
+	// the remote address is allowed. It's checked in addition to
+	// AllowedBackend, after the TLS handshake but before the connection is
+	// used to serve requests.
+	//
+	// AllowBackendConn may be called concurrently.
+	AllowBackendConn func(remote net.Addr) bool
+
+	// OnBackendConnect and OnBackendDisconnect, if not nil, are called when a
+	// backend connection is accepted and when it's closed, respectively. They
+	// are passed the hash of the backend's Ed25519 public key and the remote
+	// address of the connection.
+	//
+	// They are called without holding any lock, and may be called
+	// concurrently for different connections. For a given connection,
+	// OnBackendDisconnect is called after OnBackendConnect returns.
+	OnBackendConnect    func(keyHash [sha256.Size]byte, remote net.Addr)
+	OnBackendDisconnect func(keyHash [sha256.Size]byte, remote net.Addr)
+
+	// RetryOnReconnect, if positive, is how long a request waits for its
+	// backend to reconnect if the backend connection fails while serving it.
+	// The request is then retried once on the new connection.
+	//
+	// Only requests with safe methods (GET, HEAD, OPTIONS, and TRACE) are
+	// retried, unless RetryUnsafeMethods is true. The bodies of those requests
+	// are buffered in memory to be replayed, so they should be bounded, for
+	// example with [http.MaxBytesHandler]. Bodies that exceed the limit are
+	// served a 413 Request Entity Too Large status.
+	RetryOnReconnect   time.Duration
+	RetryUnsafeMethods bool
+
+	// FlushInterval is the flush interval of the reverse proxy, as in
+	// [httputil.ReverseProxy.FlushInterval]. A negative value flushes
+	// immediately after each write. Streaming responses, such as
+	// server-sent events, and responses without a Content-Length are always
+	// flushed immediately. If zero, other responses are not flushed
+	// periodically.
+	FlushInterval time.Duration
+
+	// AccessLog, if true, logs a line (as INFO) for each request forwarded to
+	// a backend, once the backend responds or the request fails, with the
+	// backend, the method, the first segment of the path, the status, and
+	// the duration. Requests that fail to reach the backend are logged as
+	// 502 Bad Gateway. Note that this can be high-volume.
+	AccessLog bool
+
 	// Log is used to log backend connections states (as INFO) and errors in
 	// forwarding requests (as DEBUG). If nil, [slog.Default] is used.
 	Log *slog.Logger
@@ -55,6 +126,23 @@ type Bastion struct {
 
 type keyHash [sha256.Size]byte
 
+// backendContextKey is the context key for the hex-encoded key hash of the
+// backend a request is routed to, set by ServeHTTP and read by the proxy.
+type backendContextKey struct{}
+
+// errInvalidBackend is returned by the pool RoundTrip if the request doesn't
+// carry a valid backend key hash, which would be a bug.
+var errInvalidBackend = errors.New("invalid backend key hash")
+
+// errorStatus returns the status code served for a request that failed to
+// be proxied with err.
+func errorStatus(err error) int {
+	if errors.Is(err, errInvalidBackend) {
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadGateway
+}
+
 func (kh keyHash) String() string {
 	return hex.EncodeToString(kh[:])
 }
@@ -65,8 +153,25 @@ func (kh keyHash) String() string {
 func New(c *Config) (*Bastion, error) {
 	b := &Bastion{c: c}
 	b.pool = &backendConnectionsPool{
-		log:   slog.Default(),
-		conns: make(map[keyHash]*http2.ClientConn),
+		log:       slog.Default(),
+		conns:     make(map[keyHash]*http2.ClientConn),
+		allowConn: c.AllowBackendConn,
+		label:     c.BackendLabel,
+		onConnect: c.OnBackendConnect,
+		onClose:   c.OnBackendDisconnect,
+		rate:      c.PerBackendRate,
+		burst:     float64(c.PerBackendBurst),
+		limiters:  make(map[keyHash]*tokenBucket),
+
+		retryWait:   c.RetryOnReconnect,
+		retryUnsafe: c.RetryUnsafeMethods,
+		accessLog:   c.AccessLog,
+
+		requests: make(map[int]int64),
+		h2Errors: make(map[string]int64),
+	}
+	if b.pool.burst == 0 {
+		b.pool.burst = math.Ceil(c.PerBackendRate)
 	}
 	if c.Log != nil {
 		b.pool.log = c.Log
@@ -74,17 +179,69 @@ func New(c *Config) (*Bastion, error) {
 	b.proxy = &httputil.ReverseProxy{
 		Rewrite: func(pr *httputil.ProxyRequest) {
 			pr.Out.URL.Scheme = "https" // needed for the required :scheme header
-			pr.Out.Host = pr.In.Context().Value("backend").(string)
+			// If the backend is missing, Host is left empty, and RoundTrip
+			// fails with errInvalidBackend.
+			pr.Out.Host, _ = pr.In.Context().Value(backendContextKey{}).(string)
 			pr.SetXForwarded()
 			// We don't interpret the query, so pass it on unmodified.
 			pr.Out.URL.RawQuery = pr.In.URL.RawQuery
 		},
-		Transport: b.pool,
-		ErrorLog:  slog.NewLogLogger(b.pool.log.Handler(), slog.LevelDebug),
+		Transport:     b.pool,
+		FlushInterval: c.FlushInterval,
+		ErrorLog:      slog.NewLogLogger(b.pool.log.Handler(), slog.LevelDebug),
+		ModifyResponse: func(r *http.Response) error {
+			b.pool.countRequest(r.StatusCode)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			b.pool.log.Debug("failed to proxy request", "err", err)
+			code := errorStatus(err)
+			b.pool.countRequest(code)
+			w.WriteHeader(code)
+		},
 	}
 	return b, nil
 }
 
+// Metrics is a snapshot of the counters of a Bastion.
+type Metrics struct {
+	// ConnectedBackends is the number of currently connected backends.
+	ConnectedBackends int
+
+	// Requests is the number of requests proxied to backends, by response
+	// status code. Requests that failed to reach the backend are counted as
+	// 502 Bad Gateway.
+	Requests map[int]int64
+
+	// HTTP2Errors is the number of HTTP/2 errors on backend connections, by
+	// type, as reported by [http2.Transport.CountError].
+	HTTP2Errors map[string]int64
+}
+
+// Metrics returns a snapshot of the Bastion's counters.
+func (b *Bastion) Metrics() Metrics {
+	m := Metrics{
+		Requests:    make(map[int]int64),
+		HTTP2Errors: make(map[string]int64),
+	}
+	b.pool.RLock()
+	for _, cc := range b.pool.conns {
+		if !cc.State().Closed {
+			m.ConnectedBackends++
+		}
+	}
+	b.pool.RUnlock()
+	b.pool.metricsMu.Lock()
+	defer b.pool.metricsMu.Unlock()
+	for code, n := range b.pool.requests {
+		m.Requests[code] = n
+	}
+	for typ, n := range b.pool.h2Errors {
+		m.HTTP2Errors[typ] = n
+	}
+	return m
+}
+
 // ConfigureServer sets up srv to handle backend connections to the bastion. It
 // wraps TLSConfig.GetConfigForClient to intercept backend connections, and sets
 // TLSNextProto for the bastion ALPN protocol. The original tls.Config is still
@@ -146,7 +303,20 @@ func backendHash(cs tls.ConnectionState) (keyHash, error) {
 // ServeHTTP serves requests rooted at "/<hex key hash>/" by routing them to the
 // backend that authenticated with that key. Other requests are served a 404 Not
 // Found status.
+//
+// Responses are streamed back to the client as the backend writes them, but
+// since backend connections use HTTP/2, protocol upgrades (such as WebSocket)
+// and CONNECT requests are not supported, and are served a 501 Not Implemented
+// status.
 func (b *Bastion) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Like httputil.ReverseProxy, only consider it an upgrade if Upgrade is
+	// also listed in Connection, ignoring stray Upgrade headers.
+	upgrade := r.Header.Get("Upgrade") != "" &&
+		httpguts.HeaderValuesContainsToken(r.Header["Connection"], "Upgrade")
+	if r.Method == http.MethodConnect || upgrade {
+		http.Error(w, "protocol upgrades and CONNECT are not supported", http.StatusNotImplemented)
+		return
+	}
 	path := r.URL.Path
 	if !strings.HasPrefix(path, "/") {
 		http.Error(w, "request must start with /KEY_HASH/", http.StatusNotFound)
@@ -158,9 +328,36 @@ func (b *Bastion) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "request must start with /KEY_HASH/", http.StatusNotFound)
 		return
 	}
-	ctx := context.WithValue(r.Context(), "backend", kh)
+	// Reject malformed key hashes early, as they are almost always scanners,
+	// and would otherwise surface as proxy errors.
+	h, err := hex.DecodeString(kh)
+	if err != nil || len(h) != sha256.Size {
+		http.Error(w, "request must start with /KEY_HASH/", http.StatusNotFound)
+		return
+	}
+	if !b.pool.allow(keyHash(h)) {
+		b.pool.log.Debug("backend rate limit exceeded", b.pool.backendAttrs(keyHash(h))...)
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+	ctx := context.WithValue(r.Context(), backendContextKey{}, kh)
 	r = r.Clone(ctx)
 	r.URL.Path = "/" + path
+	if b.pool.retryableMethod(r.Method) && r.Body != nil && r.Body != http.NoBody {
+		body, err := io.ReadAll(r.Body)
+		if maxErr := (*http.MaxBytesError)(nil); errors.As(err, &maxErr) {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.ContentLength = int64(len(body))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		r.Body, _ = r.GetBody()
+	}
 	b.proxy.ServeHTTP(w, r)
 }
 
@@ -184,21 +381,169 @@ func (b *Bastion) FlushBackendConnections(ctx context.Context) {
 				wg.Done()
 			}()
 			delete(b.pool.conns, kh)
+			delete(b.pool.limiters, kh)
 		}
 	}
 }
 
+// Close shuts down all backend connections, and stops accepting new ones.
+// Requests for backends are then served a 502 Bad Gateway status.
+//
+// ctx is passed to [http2.ClientConn.Shutdown], and Close waits for all
+// connections to be closed. Connections that don't shut down gracefully
+// before ctx is done are closed forcibly, and Close returns the error.
+//
+// Close should be called before shutting down the [http.Server], which doesn't
+// track backend connections.
+func (b *Bastion) Close(ctx context.Context) error {
+	b.pool.Lock()
+	b.pool.closed = true
+	conns := b.pool.conns
+	b.pool.conns = make(map[keyHash]*http2.ClientConn)
+	b.pool.limiters = make(map[keyHash]*tokenBucket)
+	b.pool.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(conns))
+	for _, cc := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := cc.Shutdown(ctx); err != nil {
+				cc.Close()
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
 type backendConnectionsPool struct {
 	log *slog.Logger
 	sync.RWMutex
-	conns map[keyHash]*http2.ClientConn
+	closed    bool
+	conns     map[keyHash]*http2.ClientConn
+	allowConn func(net.Addr) bool
+	label     func([sha256.Size]byte) string
+	onConnect func([sha256.Size]byte, net.Addr)
+	onClose   func([sha256.Size]byte, net.Addr)
+
+	// limiters is protected by limitersMu and a read lock on the pool, so
+	// entries can be removed holding just the pool write lock.
+	rate, burst float64
+	limitersMu  sync.Mutex
+	limiters    map[keyHash]*tokenBucket
+
+	retryWait   time.Duration
+	retryUnsafe bool
+	accessLog   bool
+
+	metricsMu sync.Mutex
+	requests  map[int]int64
+	h2Errors  map[string]int64
+}
+
+// backendAttrs returns the log attributes that identify a backend.
+func (p *backendConnectionsPool) backendAttrs(backend keyHash) []any {
+	attrs := []any{"backend", backend}
+	if p.label != nil {
+		if label := p.label(backend); label != "" {
+			attrs = append(attrs, "label", label)
+		}
+	}
+	return attrs
+}
+
+func (p *backendConnectionsPool) countRequest(code int) {
+	p.metricsMu.Lock()
+	defer p.metricsMu.Unlock()
+	p.requests[code]++
+}
+
+func (p *backendConnectionsPool) countH2Error(errType string) {
+	p.metricsMu.Lock()
+	defer p.metricsMu.Unlock()
+	p.h2Errors[errType]++
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow returns whether a request to backend fits in its rate limit, and
+// consumes a token if so. Limiters are only kept for connected backends, so
+// requests for other backends are always allowed (and later fail).
+func (p *backendConnectionsPool) allow(backend keyHash) bool {
+	if p.rate <= 0 {
+		return true
+	}
+	p.RLock()
+	defer p.RUnlock()
+	// Closed connections stay in conns until replaced, but their limiter is
+	// dropped and must not be recreated.
+	if cc, ok := p.conns[backend]; !ok || cc.State().Closed {
+		return true
+	}
+	p.limitersMu.Lock()
+	defer p.limitersMu.Unlock()
+	now := time.Now()
+	b, ok := p.limiters[backend]
+	if !ok {
+		b = &tokenBucket{tokens: p.burst, last: now}
+		p.limiters[backend] = b
+	}
+	b.tokens = min(p.burst, b.tokens+now.Sub(b.last).Seconds()*p.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
 }
 
 func (p *backendConnectionsPool) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !p.accessLog {
+		return p.roundTrip(r)
+	}
+	start := time.Now()
+	resp, err := p.roundTrip(r)
+	var code int
+	if err == nil {
+		code = resp.StatusCode
+	} else {
+		code = errorStatus(err)
+	}
+	var attrs []any
+	if kh, err := hex.DecodeString(r.Host); err == nil && len(kh) == sha256.Size {
+		attrs = p.backendAttrs(keyHash(kh))
+	}
+	attrs = append(attrs, "method", r.Method, "path", pathPrefix(r.URL.Path),
+		"code", code, "duration", time.Since(start))
+	if err != nil {
+		attrs = append(attrs, "err", err)
+	}
+	p.log.InfoContext(r.Context(), "proxied request", attrs...)
+	return resp, err
+}
+
+// pathPrefix returns the first segment of path, to log the endpoint without
+// any request-specific details.
+func pathPrefix(path string) string {
+	if prefix, _, ok := strings.Cut(strings.TrimPrefix(path, "/"), "/"); ok {
+		return "/" + prefix + "/"
+	}
+	return path
+}
+
+func (p *backendConnectionsPool) roundTrip(r *http.Request) (*http.Response, error) {
 	kh, err := hex.DecodeString(r.Host)
 	if err != nil || len(kh) != sha256.Size {
-		// TODO: return this as a response instead.
-		return nil, errors.New("invalid backend key hash")
+		// Unreachable, since ServeHTTP already checked the key hash and
+		// stored it in the request context.
+		return nil, errInvalidBackend
 	}
 	p.RLock()
 	cc, ok := p.conns[keyHash(kh)]
@@ -207,7 +552,62 @@ func (p *backendConnectionsPool) RoundTrip(r *http.Request) (*http.Response, err
 		// TODO: return this as a response instead.
 		return nil, errors.New("backend unavailable")
 	}
-	return cc.RoundTrip(r)
+	resp, err := cc.RoundTrip(r)
+	// If the connection can't take new requests after a failure, it's either
+	// broken or being replaced, so it's worth waiting for a new one. Bodies of
+	// retryable requests were buffered by ServeHTTP, and have a GetBody.
+	if err != nil && p.retryableMethod(r.Method) && !cc.CanTakeNewRequest() &&
+		(r.Body == nil || r.GetBody != nil) {
+		newCC := p.waitReconnect(r.Context(), keyHash(kh), cc)
+		if newCC == nil {
+			return nil, err
+		}
+		p.log.Debug("retrying request on new backend connection",
+			append(p.backendAttrs(keyHash(kh)), "err", err)...)
+		r = r.Clone(r.Context())
+		if r.GetBody != nil {
+			if r.Body, err = r.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		return newCC.RoundTrip(r)
+	}
+	return resp, err
+}
+
+// retryableMethod returns whether requests with the given method are retried
+// on a new connection if their backend connection fails.
+func (p *backendConnectionsPool) retryableMethod(method string) bool {
+	if p.retryWait <= 0 {
+		return false
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return p.retryUnsafe
+}
+
+// waitReconnect waits up to p.retryWait for a usable connection for backend
+// other than old, and returns it, or nil if none appeared in time.
+func (p *backendConnectionsPool) waitReconnect(ctx context.Context, backend keyHash, old *http2.ClientConn) *http2.ClientConn {
+	ctx, cancel := context.WithTimeout(ctx, p.retryWait)
+	defer cancel()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		p.RLock()
+		cc, ok := p.conns[backend]
+		p.RUnlock()
+		if ok && cc != old && cc.CanTakeNewRequest() {
+			return cc
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
 }
 
 func (p *backendConnectionsPool) handleBackend(hs *http.Server, c *tls.Conn, h http.Handler) {
@@ -216,12 +616,17 @@ func (p *backendConnectionsPool) handleBackend(hs *http.Server, c *tls.Conn, h h
 		p.log.Info("failed to get backend hash", "err", err)
 		return
 	}
-	l := p.log.With("backend", backend, "remote", c.RemoteAddr())
+	l := p.log.With(p.backendAttrs(backend)...).With("remote", c.RemoteAddr())
+	if p.allowConn != nil && !p.allowConn(c.RemoteAddr()) {
+		l.Info("rejected backend connection from disallowed address")
+		return
+	}
 	t := &http2.Transport{
 		// Send a PING every 15s, with the default 15s timeout.
 		ReadIdleTimeout: 15 * time.Second,
 		CountError: func(errType string) {
 			l.Info("HTTP/2 transport error", "type", errType)
+			p.countH2Error(errType)
 		},
 	}
 	cc, err := t.NewClientConn(c)
@@ -238,6 +643,12 @@ func (p *backendConnectionsPool) handleBackend(hs *http.Server, c *tls.Conn, h h
 	}
 
 	p.Lock()
+	if p.closed {
+		p.Unlock()
+		l.Info("rejected backend connection, bastion is closed")
+		cc.Close()
+		return
+	}
 	if oldCC, ok := p.conns[backend]; ok && !oldCC.State().Closed {
 		go func() {
 			ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
@@ -250,11 +661,26 @@ func (p *backendConnectionsPool) handleBackend(hs *http.Server, c *tls.Conn, h h
 	p.conns[backend] = cc
 	p.Unlock()
 
-	l.Info("accepted new backend connection")
+	// The certificate is self-signed and only its key is checked, but its
+	// other details can help spot odd or stale backends.
+	cert := c.ConnectionState().PeerCertificates[0]
+	l.Info("accepted new backend connection", "serial", cert.SerialNumber,
+		"not_before", cert.NotBefore, "not_after", cert.NotAfter)
+	if p.onConnect != nil {
+		p.onConnect(backend, c.RemoteAddr())
+	}
 	// We need not to return, or http.Server will close this connection.
 	// There is no way to wait for the ClientConn's closing, so we poll.
 	for !cc.State().Closed {
 		time.Sleep(1 * time.Second)
 	}
+	p.Lock()
+	if p.conns[backend] == cc {
+		delete(p.limiters, backend)
+	}
+	p.Unlock()
 	l.Info("backend connection closed")
+	if p.onClose != nil {
+		p.onClose(backend, c.RemoteAddr())
+	}
 }
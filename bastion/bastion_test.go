@@ -0,0 +1,660 @@
+package bastion_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"filippo.io/litetlog/bastion"
+	"golang.org/x/net/http2"
+)
+
+func TestStreaming(t *testing.T) {
+	tb := newTestBastion(t, &bastion.Config{})
+	next := make(chan struct{})
+	kh := tb.connectBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := range 3 {
+			fmt.Fprintf(w, "chunk %d\n", i)
+			w.(http.Flusher).Flush()
+			<-next
+		}
+	}))
+
+	resp, err := tb.client.Get(tb.url + "/" + kh + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	br := bufio.NewReader(resp.Body)
+	for i := range 3 {
+		// Each chunk must arrive before the backend writes the next one.
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("chunk %d\n", i); line != want {
+			t.Errorf("got %q, want %q", line, want)
+		}
+		next <- struct{}{}
+	}
+	if rest, err := io.ReadAll(br); err != nil || len(rest) != 0 {
+		t.Errorf("unexpected trailing data %q, err %v", rest, err)
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	tb := newTestBastion(t, &bastion.Config{FlushInterval: -1})
+	next := make(chan struct{})
+	kh := tb.connectBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// With a Content-Length, the response is not detected as streaming.
+		w.Header().Set("Content-Length", "16")
+		io.WriteString(w, "chunk 0\n")
+		w.(http.Flusher).Flush()
+		<-next
+		io.WriteString(w, "chunk 1\n")
+	}))
+
+	resp, err := tb.client.Get(tb.url + "/" + kh + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	br := bufio.NewReader(resp.Body)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "chunk 0\n" {
+		t.Errorf("got %q, want %q", line, "chunk 0\n")
+	}
+	close(next)
+	if rest, err := io.ReadAll(br); err != nil || string(rest) != "chunk 1\n" {
+		t.Errorf("got trailing data %q, err %v", rest, err)
+	}
+}
+
+func TestRetryOnReconnect(t *testing.T) {
+	tb := newTestBastion(t, &bastion.Config{
+		RetryOnReconnect:   5 * time.Second,
+		RetryUnsafeMethods: true,
+	})
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dropped := make(chan struct{})
+	kh, conn := tb.connectBackendWithKey(t, priv, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		close(dropped)
+		<-r.Context().Done()
+	}))
+
+	type result struct {
+		body string
+		err  error
+	}
+	res := make(chan result)
+	go func() {
+		resp, err := tb.client.Post(tb.url+"/"+kh+"/echo", "text/plain", strings.NewReader("hello"))
+		if err != nil {
+			res <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("got status %d: %s", resp.StatusCode, body)
+		}
+		res <- result{string(body), err}
+	}()
+
+	<-dropped
+	conn.Close()
+	tb.connectBackendWithKey(t, priv, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+
+	r := <-res
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.body != "hello" {
+		t.Errorf("got body %q, want %q", r.body, "hello")
+	}
+}
+
+func TestPerBackendRate(t *testing.T) {
+	get := func(t *testing.T, tb *testBastion, kh string) int {
+		t.Helper()
+		resp, err := tb.client.Get(tb.url + "/" + kh + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	expect := func(t *testing.T, tb *testBastion, kh string, want ...int) {
+		t.Helper()
+		for i, w := range want {
+			if got := get(t, tb, kh); got != w {
+				t.Errorf("request %d: got status %d, want %d", i, got, w)
+			}
+		}
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	t.Run("Burst", func(t *testing.T) {
+		tb := newTestBastion(t, &bastion.Config{PerBackendRate: 5, PerBackendBurst: 2})
+		kh := tb.connectBackend(t, ok)
+		expect(t, tb, kh, 200, 200, 429)
+
+		// The backend connection is still usable once tokens are refilled.
+		time.Sleep(300 * time.Millisecond)
+		expect(t, tb, kh, 200)
+		if m := tb.b.Metrics(); m.ConnectedBackends != 1 {
+			t.Errorf("got %d connected backends, want 1", m.ConnectedBackends)
+		}
+
+		// Unknown key hashes are not limited.
+		unknown := strings.Repeat("00", sha256.Size)
+		expect(t, tb, unknown, 502, 502, 502)
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		var allowed atomic.Bool
+		allowed.Store(true)
+		disconnected := make(chan [sha256.Size]byte, 10)
+		tb := newTestBastion(t, &bastion.Config{
+			// Effectively no refill during the test.
+			PerBackendRate:  0.001,
+			PerBackendBurst: 2,
+			AllowedBackend: func([sha256.Size]byte) bool {
+				return allowed.Load()
+			},
+			OnBackendDisconnect: func(kh [sha256.Size]byte, remote net.Addr) {
+				disconnected <- kh
+			},
+		})
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitDisconnect := func() {
+			select {
+			case <-disconnected:
+			case <-time.After(5 * time.Second):
+				t.Fatal("backend did not disconnect")
+			}
+		}
+
+		kh, conn := tb.connectBackendWithKey(t, priv, ok)
+		expect(t, tb, kh, 200, 200, 429)
+
+		// The limiter is dropped when the backend disconnects.
+		conn.Close()
+		waitDisconnect()
+		// Requests to the disconnected backend don't recreate it.
+		expect(t, tb, kh, 502, 502, 502)
+		tb.connectBackendWithKey(t, priv, ok)
+		expect(t, tb, kh, 200, 200, 429)
+
+		// The limiter is dropped when the backend is flushed.
+		allowed.Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		tb.b.FlushBackendConnections(ctx)
+		waitDisconnect()
+		allowed.Store(true)
+		tb.connectBackendWithKey(t, priv, ok)
+		expect(t, tb, kh, 200, 200, 429)
+	})
+}
+
+func TestAllowBackendConn(t *testing.T) {
+	var mu sync.Mutex
+	var logs strings.Builder
+	var remotes []net.Addr
+	tb := newTestBastion(t, &bastion.Config{
+		AllowBackendConn: func(remote net.Addr) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			remotes = append(remotes, remote)
+			return false
+		},
+		Log: slog.New(slog.NewTextHandler(writerFunc(func(p []byte) (int, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return logs.Write(p)
+		}), nil)),
+	})
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := tb.dialBackend(t, priv)
+	done := make(chan struct{})
+	go func() {
+		(&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: http.NotFoundHandler()})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend connection was not closed")
+	}
+
+	select {
+	case <-tb.connected:
+		t.Error("rejected backend was connected")
+	default:
+	}
+	if m := tb.b.Metrics(); m.ConnectedBackends != 0 {
+		t.Errorf("got %d connected backends, want 0", m.ConnectedBackends)
+	}
+	kh := sha256.Sum256(priv.Public().(ed25519.PublicKey))
+	resp, err := tb.client.Get(tb.url + "/" + hex.EncodeToString(kh[:]) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("got status %d, want 502", resp.StatusCode)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(remotes) != 1 || remotes[0].String() != conn.LocalAddr().String() {
+		t.Errorf("AllowBackendConn called with %v, want [%v]", remotes, conn.LocalAddr())
+	}
+	want := "rejected backend connection from disallowed address"
+	if !strings.Contains(logs.String(), want) {
+		t.Errorf("logs don't contain %q:\n%s", want, logs.String())
+	}
+}
+
+func TestInvalidKeyHash(t *testing.T) {
+	tb := newTestBastion(t, &bastion.Config{})
+	for _, path := range []string{
+		"/",
+		"/index.html",
+		"/wp-login.php/foo",
+		"/" + strings.Repeat("zz", sha256.Size) + "/foo",
+		"/" + strings.Repeat("00", sha256.Size-1) + "/foo",
+	} {
+		resp, err := tb.client.Get(tb.url + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want 404", path, resp.StatusCode)
+		}
+	}
+	if m := tb.b.Metrics(); len(m.Requests) != 0 {
+		t.Errorf("invalid requests were proxied: %v", m.Requests)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	tb := newTestBastion(t, &bastion.Config{})
+	kh := tb.connectBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ok" {
+			http.NotFound(w, r)
+		}
+	}))
+
+	for _, path := range []string{
+		"/" + kh + "/ok",
+		"/" + kh + "/ok",
+		"/" + kh + "/missing",
+		"/" + strings.Repeat("00", sha256.Size) + "/ok",
+	} {
+		resp, err := tb.client.Get(tb.url + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	m := tb.b.Metrics()
+	if m.ConnectedBackends != 1 {
+		t.Errorf("got %d connected backends, want 1", m.ConnectedBackends)
+	}
+	want := map[int]int64{200: 2, 404: 1, 502: 1}
+	if !maps.Equal(m.Requests, want) {
+		t.Errorf("got requests %v, want %v", m.Requests, want)
+	}
+}
+
+func TestBackendConnectionLog(t *testing.T) {
+	var mu sync.Mutex
+	var logs strings.Builder
+	tb := newTestBastion(t, &bastion.Config{
+		BackendLabel: func(keyHash [sha256.Size]byte) string {
+			return "test-backend"
+		},
+		Log: slog.New(slog.NewTextHandler(writerFunc(func(p []byte) (int, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return logs.Write(p)
+		}), nil)),
+	})
+	kh := tb.connectBackend(t, http.NotFoundHandler())
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, want := range []string{
+		"backend=" + kh + " label=test-backend",
+		"serial=1 not_before=",
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("logs don't contain %q:\n%s", want, logs.String())
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var mu sync.Mutex
+	var logs strings.Builder
+	tb := newTestBastion(t, &bastion.Config{
+		AccessLog: true,
+		Log: slog.New(slog.NewTextHandler(writerFunc(func(p []byte) (int, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return logs.Write(p)
+		}), nil)),
+	})
+	kh := tb.connectBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	resp, err := tb.client.Get(tb.url + "/" + kh + "/tile/8/0/000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := "msg=\"proxied request\" backend=" + kh + " method=GET path=/tile/ code=418 duration="
+	if !strings.Contains(logs.String(), want) {
+		t.Errorf("logs don't contain %q:\n%s", want, logs.String())
+	}
+	if strings.Contains(logs.String(), "/tile/8") {
+		t.Errorf("logs contain the full path:\n%s", logs.String())
+	}
+}
+
+func TestClose(t *testing.T) {
+	disconnected := make(chan [sha256.Size]byte, 10)
+	tb := newTestBastion(t, &bastion.Config{
+		OnBackendDisconnect: func(kh [sha256.Size]byte, remote net.Addr) {
+			disconnected <- kh
+		},
+	})
+	kh := tb.connectBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tb.b.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend was not disconnected")
+	}
+	if m := tb.b.Metrics(); m.ConnectedBackends != 0 {
+		t.Errorf("got %d connected backends, want 0", m.ConnectedBackends)
+	}
+
+	resp, err := tb.client.Get(tb.url + "/" + kh + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("got status %d, want 502", resp.StatusCode)
+	}
+
+	// New backend connections are rejected.
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := tb.dialBackend(t, priv)
+	done := make(chan struct{})
+	go func() {
+		(&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: http.NotFoundHandler()})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("backend connection was not closed")
+	}
+	select {
+	case <-tb.connected:
+		t.Error("backend connected after Close")
+	default:
+	}
+}
+
+func TestUpgradeNotSupported(t *testing.T) {
+	b, err := bastion.New(&bastion.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kh := strings.Repeat("00", sha256.Size)
+
+	r := httptest.NewRequest("GET", "/"+kh+"/ws", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, r)
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("Upgrade: got status %d, want %d", w.Code, http.StatusNotImplemented)
+	}
+
+	r = httptest.NewRequest("CONNECT", "/"+kh+"/", nil)
+	w = httptest.NewRecorder()
+	b.ServeHTTP(w, r)
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("CONNECT: got status %d, want %d", w.Code, http.StatusNotImplemented)
+	}
+
+	// A stray Upgrade header without Connection: Upgrade is not an upgrade,
+	// and the request fails only because the backend is not connected.
+	r = httptest.NewRequest("GET", "/"+kh+"/", nil)
+	r.Header.Set("Upgrade", "websocket")
+	w = httptest.NewRecorder()
+	b.ServeHTTP(w, r)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("stray Upgrade: got status %d, want %d", w.Code, http.StatusBadGateway)
+	}
+}
+
+type testBastion struct {
+	b      *bastion.Bastion
+	url    string
+	addr   string
+	roots  *x509.CertPool
+	client *http.Client
+
+	connected chan [sha256.Size]byte
+}
+
+// newTestBastion starts a bastion serving on a local port with a self-signed
+// certificate. c.AllowedBackend, c.GetCertificate, and c.Log are set if nil,
+// and c.OnBackendConnect is wrapped to let connectBackend wait for backends.
+func newTestBastion(t *testing.T, c *bastion.Config) *testBastion {
+	connected := make(chan [sha256.Size]byte, 10)
+	onConnect := c.OnBackendConnect
+	c.OnBackendConnect = func(kh [sha256.Size]byte, remote net.Addr) {
+		if onConnect != nil {
+			onConnect(kh, remote)
+		}
+		connected <- kh
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(1 * time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	if c.GetCertificate == nil {
+		c.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cert, nil
+		}
+	}
+	if c.AllowedBackend == nil {
+		c.AllowedBackend = func([sha256.Size]byte) bool { return true }
+	}
+	if c.Log == nil {
+		c.Log = slog.New(slog.NewTextHandler(writerFunc(func(p []byte) (int, error) {
+			t.Logf("%s", p)
+			return len(p), nil
+		}), &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+	b, err := bastion.New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hs := &http.Server{
+		Handler:   b,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{*cert}},
+	}
+	if err := b.ConfigureServer(hs); err != nil {
+		t.Fatal(err)
+	}
+	if err := http2.ConfigureServer(hs, nil); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hs.ServeTLS(l, "", "")
+	t.Cleanup(func() { hs.Close() })
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &testBastion{
+		b:      b,
+		url:    "https://" + l.Addr().String(),
+		addr:   l.Addr().String(),
+		roots:  roots,
+		client: &http.Client{Transport: transport},
+
+		connected: connected,
+	}
+}
+
+// connectBackend connects a new backend serving h to the bastion, waits for
+// it to be available, and returns its hex-encoded key hash.
+func (tb *testBastion) connectBackend(t *testing.T, h http.Handler) string {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kh, _ := tb.connectBackendWithKey(t, priv, h)
+	return kh
+}
+
+// connectBackendWithKey is like connectBackend, but authenticates with priv,
+// and also returns the backend connection.
+func (tb *testBastion) connectBackendWithKey(t *testing.T, priv ed25519.PrivateKey, h http.Handler) (string, net.Conn) {
+	conn := tb.dialBackend(t, priv)
+	go (&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: h})
+
+	kh := sha256.Sum256(priv.Public().(ed25519.PublicKey))
+	select {
+	case got := <-tb.connected:
+		if got != kh {
+			t.Fatalf("unexpected backend %x connected", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend did not connect")
+	}
+	return hex.EncodeToString(kh[:]), conn
+}
+
+// dialBackend opens a backend connection to the bastion, authenticated with
+// priv, without serving it.
+func (tb *testBastion) dialBackend(t *testing.T, priv ed25519.PrivateKey) net.Conn {
+	pub := priv.Public().(ed25519.PublicKey)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(1 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", tb.addr, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}},
+		MinVersion:   tls.VersionTLS13,
+		NextProtos:   []string{"bastion/0"},
+		RootCAs:      tb.roots,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+type writerFunc func(p []byte) (n int, err error)
+
+func (f writerFunc) Write(p []byte) (n int, err error) {
+	return f(p)
+}
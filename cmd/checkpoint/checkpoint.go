@@ -0,0 +1,136 @@
+// Command checkpoint fetches the latest checkpoint of a tlog-tiles log,
+// verifies its signature and optionally its witness cosignatures, and prints
+// its contents.
+//
+// Usage:
+//
+//	checkpoint -key <vkey> [-witness <vkey>]... [-quorum N] <log URL>
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"filippo.io/litetlog/internal/tlogx"
+	"golang.org/x/mod/sumdb/note"
+)
+
+func main() {
+	keyFlag := flag.String("key", "", "the log's public key")
+	originFlag := flag.String("origin", "",
+		"the expected log origin (default: the name of the log's public key)")
+	var witnesses []note.Verifier
+	flag.Func("witness", "a witness public key, may be repeated", func(s string) error {
+		v, err := tlogx.NewCosignatureV1Verifier(s)
+		if err != nil {
+			return err
+		}
+		witnesses = append(witnesses, v)
+		return nil
+	})
+	quorumFlag := flag.Int("quorum", -1,
+		"number of witness cosignatures required (default: all witnesses)")
+	flag.Parse()
+
+	if *keyFlag == "" {
+		log.Fatalf("-key is required")
+	}
+	if flag.NArg() != 1 {
+		log.Fatalf("usage: checkpoint -key <vkey> [-witness <vkey>]... <log URL>")
+	}
+	logVerifier, err := note.NewVerifier(*keyFlag)
+	if err != nil {
+		log.Fatalf("could not parse public key: %v", err)
+	}
+	origin := *originFlag
+	if origin == "" {
+		origin = logVerifier.Name()
+	}
+	quorum := *quorumFlag
+	if quorum < 0 {
+		quorum = len(witnesses)
+	}
+	if quorum > len(witnesses) {
+		log.Fatalf("quorum %d is larger than the number of witnesses (%d)", quorum, len(witnesses))
+	}
+
+	checkpoint, err := fetchCheckpoint(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("could not fetch checkpoint: %v", err)
+	}
+
+	verifiers := append([]note.Verifier{logVerifier}, witnesses...)
+	n, err := note.Open(checkpoint, note.VerifierList(verifiers...))
+	if err != nil {
+		log.Fatalf("could not verify checkpoint: %v", err)
+	}
+	if !hasSignatureFrom(n, logVerifier) {
+		log.Fatalf("checkpoint is not signed by the log")
+	}
+	c, err := tlogx.ParseCheckpoint(n.Text)
+	if err != nil {
+		log.Fatalf("could not parse checkpoint: %v", err)
+	}
+	if c.Origin != origin {
+		log.Fatalf("checkpoint origin is %q, expected %q", c.Origin, origin)
+	}
+
+	fmt.Printf("origin: %s\n", c.Origin)
+	fmt.Printf("size: %d\n", c.N)
+	fmt.Printf("hash: %s\n", c.Hash)
+	cosigned, err := tlogx.CountCosignatures(checkpoint, witnesses)
+	if err != nil {
+		log.Fatalf("could not verify cosignatures: %v", err)
+	}
+	for _, w := range cosigned {
+		for _, sig := range n.Sigs {
+			if sig.Name == w.Name() && sig.Hash == w.KeyHash() {
+				t := time.Unix(int64(cosignatureTimestamp(sig)), 0).UTC()
+				fmt.Printf("witness: %s (cosigned at %s)\n", w.Name(), t.Format(time.RFC3339))
+			}
+		}
+	}
+	if len(cosigned) < quorum {
+		log.Fatalf("got %d witness cosignatures, need %d", len(cosigned), quorum)
+	}
+}
+
+func fetchCheckpoint(logURL string) ([]byte, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(logURL, "/") + "/checkpoint")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+func hasSignatureFrom(n *note.Note, v note.Verifier) bool {
+	for _, sig := range n.Sigs {
+		if sig.Name == v.Name() && sig.Hash == v.KeyHash() {
+			return true
+		}
+	}
+	return false
+}
+
+// cosignatureTimestamp returns the timestamp of a verified cosignature/v1
+// signature, which is encoded in its first eight bytes.
+func cosignatureTimestamp(sig note.Signature) uint64 {
+	b, err := base64.StdEncoding.DecodeString(sig.Base64)
+	if err != nil || len(b) < 4+8 {
+		return 0
+	}
+	// The signature is prefixed by the four-byte key hash.
+	return binary.BigEndian.Uint64(b[4:])
+}
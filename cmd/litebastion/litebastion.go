@@ -17,12 +17,16 @@ import (
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -35,11 +39,15 @@ import (
 
 var listenAddr = flag.String("listen", "localhost:8443", "host and port to listen at")
 var testCertificates = flag.Bool("testcert", false, "use localhost.pem and localhost-key.pem instead of ACME")
+var certFile = flag.String("cert", "", "PEM certificate chain file to use instead of ACME, reloaded on SIGHUP")
+var keyFile = flag.String("key", "", "PEM private key file for -cert")
 var autocertCache = flag.String("cache", "", "directory to cache ACME certificates at")
 var autocertHost = flag.String("host", "", "host to obtain ACME certificate for")
 var autocertEmail = flag.String("email", "", "")
-var allowedBackendsFile = flag.String("backends", "", "file of accepted key hashes, one per line, reloaded on SIGHUP")
+var allowedBackendsFile = flag.String("backends", "", "file of accepted key hashes, one per line optionally followed by a name, reloaded on SIGHUP")
 var homeRedirect = flag.String("home-redirect", "", "redirect / to this URL")
+var metricsListenAddr = flag.String("metrics-listen", "", "host and port to serve Prometheus metrics at over plain HTTP, disabled if empty")
+var accessLog = flag.Bool("access-log", false, "log each proxied request with its backend, status, and duration")
 
 type keyHash [sha256.Size]byte
 
@@ -54,7 +62,31 @@ func main() {
 	slog.SetLogLoggerLevel(slog.LevelDebug)
 
 	var getCertificate func(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
-	if *testCertificates {
+	// reloadCertificate is nil unless -cert is used.
+	var reloadCertificate func() error
+	if (*certFile != "") != (*keyFile != "") {
+		logFatal("-cert and -key must be used together")
+	}
+	if *certFile != "" && (*testCertificates || *autocertCache != "" || *autocertHost != "") {
+		logFatal("-cert can't be used with -testcert or ACME flags")
+	}
+	if *certFile != "" {
+		var cert atomic.Pointer[tls.Certificate]
+		reloadCertificate = func() error {
+			c, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+			if err != nil {
+				return err
+			}
+			cert.Store(&c)
+			return nil
+		}
+		if err := reloadCertificate(); err != nil {
+			logFatal("can't load certificate", "err", err)
+		}
+		getCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cert.Load(), nil
+		}
+	} else if *testCertificates {
 		cert, err := tls.LoadX509KeyPair("localhost.pem", "localhost-key.pem")
 		if err != nil {
 			logFatal("can't load test certificates", "err", err)
@@ -64,7 +96,7 @@ func main() {
 		}
 	} else {
 		if *autocertCache == "" || *autocertHost == "" || *autocertEmail == "" {
-			logFatal("-cache, -host, and -email or -testcert are required")
+			logFatal("-cache, -host, and -email, or -cert and -key, or -testcert are required")
 		}
 		m := &autocert.Manager{
 			Cache:      autocert.DirCache(*autocertCache),
@@ -79,24 +111,33 @@ func main() {
 		logFatal("-backends is missing")
 	}
 	var allowedBackendsMu sync.RWMutex
-	var allowedBackends map[keyHash]bool
+	// allowedBackends maps accepted key hashes to their name, if any.
+	var allowedBackends map[keyHash]string
 	reloadBackends := func() error {
-		newBackends := make(map[keyHash]bool)
+		newBackends := make(map[keyHash]string)
 		backendsList, err := os.ReadFile(*allowedBackendsFile)
 		if err != nil {
 			return err
 		}
 		bs := strings.TrimSpace(string(backendsList))
 		for _, line := range strings.Split(bs, "\n") {
-			l, err := hex.DecodeString(line)
+			fields := strings.Fields(line)
+			if len(fields) < 1 || len(fields) > 2 {
+				return fmt.Errorf("invalid backend line: %q", line)
+			}
+			l, err := hex.DecodeString(fields[0])
 			if err != nil {
-				return fmt.Errorf("invalid backend: %q", line)
+				return fmt.Errorf("invalid backend: %q", fields[0])
 			}
 			if len(l) != sha256.Size {
-				return fmt.Errorf("invalid backend: %q", line)
+				return fmt.Errorf("invalid backend: %q", fields[0])
 			}
 			h := keyHash(l)
-			newBackends[h] = true
+			if len(fields) == 2 {
+				newBackends[h] = fields[1]
+			} else {
+				newBackends[h] = ""
+			}
 		}
 		allowedBackendsMu.Lock()
 		defer allowedBackendsMu.Unlock()
@@ -110,20 +151,49 @@ func main() {
 
 	b, err := bastion.New(&bastion.Config{
 		AllowedBackend: func(keyHash [sha256.Size]byte) bool {
+			allowedBackendsMu.RLock()
+			defer allowedBackendsMu.RUnlock()
+			_, ok := allowedBackends[keyHash]
+			return ok
+		},
+		BackendLabel: func(keyHash [sha256.Size]byte) string {
 			allowedBackendsMu.RLock()
 			defer allowedBackendsMu.RUnlock()
 			return allowedBackends[keyHash]
 		},
 		GetCertificate: getCertificate,
+		AccessLog:      *accessLog,
 	})
 	if err != nil {
 		logFatal("failed to create bastion", "err", err)
 	}
 
+	if *metricsListenAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("GET /metrics", metricsHandler(b))
+		ms := &http.Server{
+			Addr:         *metricsListenAddr,
+			Handler:      metricsMux,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 5 * time.Second,
+		}
+		slog.Info("serving metrics", "addr", *metricsListenAddr)
+		go func() {
+			logFatal("metrics server error", "err", ms.ListenAndServe())
+		}()
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP)
 	go func() {
 		for range c {
+			if reloadCertificate != nil {
+				if err := reloadCertificate(); err != nil {
+					slog.Error("failed to reload certificate", "err", err)
+				} else {
+					slog.Info("reloaded certificate")
+				}
+			}
 			if err := reloadBackends(); err != nil {
 				slog.Error("failed to reload backends", "err", err)
 			} else {
@@ -171,12 +241,36 @@ func main() {
 		slog.Info("shutting down on interrupt")
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
+		if err := b.Close(ctx); err != nil {
+			slog.Error("failed to shut down backend connections", "err", err)
+		}
 		hs.Shutdown(ctx)
 	case err := <-e:
 		slog.Error("server error", "err", err)
 	}
 }
 
+func metricsHandler(b *bastion.Bastion) http.HandlerFunc {
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return func(w http.ResponseWriter, r *http.Request) {
+		m := b.Metrics()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		io.WriteString(w, "# HELP litebastion_connected_backends Currently connected backends.\n")
+		io.WriteString(w, "# TYPE litebastion_connected_backends gauge\n")
+		fmt.Fprintf(w, "litebastion_connected_backends %d\n", m.ConnectedBackends)
+		io.WriteString(w, "# HELP litebastion_proxied_requests_total Requests proxied to backends by response status code.\n")
+		io.WriteString(w, "# TYPE litebastion_proxied_requests_total counter\n")
+		for _, code := range slices.Sorted(maps.Keys(m.Requests)) {
+			fmt.Fprintf(w, "litebastion_proxied_requests_total{code=\"%d\"} %d\n", code, m.Requests[code])
+		}
+		io.WriteString(w, "# HELP litebastion_http2_errors_total HTTP/2 errors on backend connections by type.\n")
+		io.WriteString(w, "# TYPE litebastion_http2_errors_total counter\n")
+		for _, typ := range slices.Sorted(maps.Keys(m.HTTP2Errors)) {
+			fmt.Fprintf(w, "litebastion_http2_errors_total{type=\"%s\"} %d\n", escape.Replace(typ), m.HTTP2Errors[typ])
+		}
+	}
+}
+
 func logFatal(msg string, args ...interface{}) {
 	slog.Error(msg, args...)
 	os.Exit(1)
@@ -15,13 +15,16 @@ import (
 	"fmt"
 	"html"
 	"io"
+	"io/fs"
 	"log/slog"
 	"math/big"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -30,6 +33,7 @@ import (
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
 	"filippo.io/litetlog/internal/slogconsole"
 	"filippo.io/litetlog/internal/witness"
@@ -38,12 +42,21 @@ import (
 var nameFlag = flag.String("name", "", "URL-like (e.g. example.com/foo) name of this witness")
 var dbFlag = flag.String("db", "litewitness.db", "path to sqlite database")
 var sshAgentFlag = flag.String("ssh-agent", "litewitness.sock", "path to ssh-agent socket")
-var listenFlag = flag.String("listen", "localhost:7380", "address to listen for HTTP requests")
+var listenFlag = flag.String("listen", "localhost:7380", "address to listen for HTTP requests, or path of a Unix socket (absolute or prefixed by unix:)")
 var keyFlag = flag.String("key", "", "SSH fingerprint (with SHA256: prefix) of the witness key")
+var keyFileFlag = flag.String("key-file", "", "path to an unencrypted OpenSSH Ed25519 private key, to use instead of -ssh-agent")
 var bastionFlag = flag.String("bastion", "", "address of the bastion(s) to reverse proxy through, comma separated, the first online one is selected")
 var testCertFlag = flag.Bool("testcert", false, "use rootCA.pem for connections to the bastion")
+var maxBodyFlag = flag.Int64("max-body", 10*1024, "maximum size in bytes of a request body")
+var readyFileFlag = flag.String("ready-file", "", "file to write the PID to once ready to serve requests, removed on shutdown")
+var h2cFlag = flag.Bool("h2c", false, "also accept HTTP/2 without TLS (h2c) on the local listener")
 
 func main() {
+	var learnKeys []string
+	flag.Func("learn-key", "verifier key of a log to add on first use, can be repeated", func(s string) error {
+		learnKeys = append(learnKeys, s)
+		return nil
+	})
 	flag.Parse()
 
 	var level = new(slog.LevelVar)
@@ -64,9 +77,22 @@ func main() {
 		}
 	}()
 
-	signer := connectToSSHAgent()
+	if *readyFileFlag != "" {
+		// Remove any stale file from a previous run.
+		if err := os.Remove(*readyFileFlag); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fatal("removing ready file", "err", err)
+		}
+	}
+
+	var signer *signer
+	if *keyFileFlag != "" {
+		signer = loadKeyFile()
+	} else {
+		signer = connectToSSHAgent()
+	}
 
-	w, err := witness.NewWitness(*dbFlag, *nameFlag, signer, slog.Default())
+	w, err := witness.NewWitness(*dbFlag, *nameFlag, signer,
+		witness.Policy{LearnKeys: learnKeys}, slog.Default())
 	if err != nil {
 		fatal("creating witness", "err", err)
 	}
@@ -78,20 +104,48 @@ func main() {
 	mux := http.NewServeMux()
 	mux.Handle("/", w)
 	mux.Handle("/logz", console)
-	mux.Handle("/{$}", indexHandler(w))
+	mux.Handle("/{$}", indexHandler(w, signer))
+	// Metrics are never served through the bastion, see below.
+	localMux := http.NewServeMux()
+	localMux.Handle("/", mux)
+	localMux.Handle("GET /metrics", metricsHandler(w))
 
 	srv := &http.Server{
 		Addr:         *listenFlag,
-		Handler:      http.MaxBytesHandler(mux, 10*1024),
+		Handler:      http.MaxBytesHandler(localMux, *maxBodyFlag),
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 5 * time.Second,
 		BaseContext:  func(net.Listener) context.Context { return ctx },
 	}
-	e := make(chan error, 1)
+	// -listen has a default, so listen locally alongside the bastion only if
+	// it was set explicitly.
+	listenSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "listen" {
+			listenSet = true
+		}
+	})
+
+	logSummary(ctx, listenSet)
+
+	// If there is a local listener, serve the index page, /logz, and /metrics
+	// only there, and not publicly through the bastion. Otherwise, the bastion
+	// serves the index page and /logz, but still not /metrics.
+	bastionHandler := http.MaxBytesHandler(mux, *maxBodyFlag)
+	if listenSet {
+		bastionHandler = http.MaxBytesHandler(w, *maxBodyFlag)
+	}
+	if *h2cFlag {
+		// Let a local reverse proxy multiplex requests over HTTP/2. HTTP/1.1
+		// requests are still served as usual.
+		srv.Handler = h2c.NewHandler(srv.Handler, &http2.Server{})
+	}
+
+	e := make(chan error, 2)
 	if *bastionFlag != "" {
 		go func() {
 			for _, bastion := range strings.Split(*bastionFlag, ",") {
-				err := connectToBastion(ctx, bastion, signer, srv)
+				err := connectToBastion(ctx, bastion, signer, srv, bastionHandler)
 				if err == errBastionDisconnected {
 					// Connection succeeded and then was interrupted. Restart to
 					// let the scheduler apply any backoff, and then retry all bastions.
@@ -101,11 +155,15 @@ func main() {
 			}
 			e <- errors.New("couldn't connect to any bastion")
 		}()
-	} else {
-		go func() {
-			slog.Info("listening", "addr", *listenFlag)
-			e <- srv.ListenAndServe()
-		}()
+	}
+	if *bastionFlag == "" || listenSet {
+		l, err := listen(*listenFlag)
+		if err != nil {
+			fatal("listening", "err", err)
+		}
+		slog.Info("listening", "addr", l.Addr())
+		markReady()
+		go func() { e <- srv.Serve(l) }()
 	}
 
 	select {
@@ -114,23 +172,130 @@ func main() {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		srv.Shutdown(ctx)
+		if *readyFileFlag != "" {
+			os.Remove(*readyFileFlag)
+		}
 	case err := <-e:
 		fatal("server error", "err", err)
 	}
 }
 
+// logSummary logs a single line summarizing the effective configuration, and
+// the number of logs and keys in the database.
+func logSummary(ctx context.Context, listenSet bool) {
+	attrs := []any{"name", *nameFlag, "db", *dbFlag}
+	switch {
+	case *bastionFlag == "":
+		attrs = append(attrs, "mode", "listen", "listen", *listenFlag)
+	case listenSet:
+		attrs = append(attrs, "mode", "bastion+listen", "bastion", *bastionFlag, "listen", *listenFlag)
+	default:
+		attrs = append(attrs, "mode", "bastion", "bastion", *bastionFlag)
+	}
+	db, err := witness.OpenDB(ctx, *dbFlag)
+	if err != nil {
+		fatal("opening database", "err", err)
+	}
+	defer db.Close()
+	for _, table := range []string{"log", "key"} {
+		var n int64
+		if err := sqlitex.Exec(db, "SELECT COUNT(*) FROM "+table, func(stmt *sqlite.Stmt) error {
+			n = stmt.ColumnInt64(0)
+			return nil
+		}); err != nil {
+			fatal("reading database", "err", err)
+		}
+		attrs = append(attrs, table+"s", n)
+	}
+	slog.Info("startup", attrs...)
+}
+
+// listen listens on addr, which is a TCP address, or a Unix socket path if
+// it's absolute or prefixed by "unix:". A stale Unix socket file is replaced,
+// and the socket file is removed when the listener is closed on shutdown.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok && !filepath.IsAbs(addr) {
+		return net.Listen("tcp", addr)
+	}
+	if !ok {
+		path = addr
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Mode().Type() == fs.ModeSocket {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// markReady writes the PID to -ready-file, if set, the first time it's called,
+// once the ssh-agent is connected and the witness is reachable.
+var markReady = sync.OnceFunc(func() {
+	if *readyFileFlag == "" {
+		return
+	}
+	if err := os.WriteFile(*readyFileFlag, fmt.Appendf(nil, "%d\n", os.Getpid()), 0644); err != nil {
+		fatal("writing ready file", "err", err)
+	}
+})
+
 func connectToSSHAgent() *signer {
+	signer, err := dialSSHAgent()
+	if err != nil {
+		fatal("connecting to ssh-agent", "err", err)
+	}
+	slog.Info("connected to ssh-agent", "addr", *sshAgentFlag)
+	slog.Info("found key", "fingerprint", *keyFlag)
+	return signer
+}
+
+// loadKeyFile loads the witness key from -key-file. If -key is set, the key
+// must match it.
+func loadKeyFile() *signer {
+	pemBytes, err := os.ReadFile(*keyFileFlag)
+	if err != nil {
+		fatal("reading key file", "err", err)
+	}
+	k, err := ssh.ParseRawPrivateKey(pemBytes)
+	if err != nil {
+		fatal("parsing key file", "err", err)
+	}
+	if pk, ok := k.(*ed25519.PrivateKey); ok {
+		k = *pk
+	}
+	if _, ok := k.(ed25519.PrivateKey); !ok {
+		fatal("key file is not an Ed25519 key", "type", fmt.Sprintf("%T", k))
+	}
+	s, err := ssh.NewSignerFromKey(k)
+	if err != nil {
+		fatal("loading key file", "err", err)
+	}
+	signer, err := newSigner(s)
+	if err != nil {
+		fatal("loading key file", "err", err)
+	}
+	fingerprint := ssh.FingerprintSHA256(s.PublicKey())
+	if *keyFlag != "" && *keyFlag != fingerprint {
+		fatal("key file does not match -key", "fingerprint", fingerprint)
+	}
+	slog.Info("loaded key file", "path", *keyFileFlag, "fingerprint", fingerprint)
+	return signer
+}
+
+// dialSSHAgent connects to the ssh-agent at -ssh-agent, and returns a signer
+// for the key selected by -key.
+func dialSSHAgent() (*signer, error) {
 	conn, err := net.Dial("unix", *sshAgentFlag)
 	if err != nil {
-		fatal("dialing ssh-agent", "err", err)
+		return nil, fmt.Errorf("dialing ssh-agent: %w", err)
 	}
 	a := agent.NewClient(conn)
 	signers, err := a.Signers()
 	if err != nil {
-		fatal("getting keys from ssh-agent", "err", err)
+		conn.Close()
+		return nil, fmt.Errorf("getting keys from ssh-agent: %w", err)
 	}
-	slog.Info("connected to ssh-agent", "addr", *sshAgentFlag)
-	var signer *signer
 	var keys []string
 	for _, s := range signers {
 		if s.PublicKey().Type() != ssh.KeyAlgoED25519 {
@@ -138,32 +303,34 @@ func connectToSSHAgent() *signer {
 		}
 		ss, err := newSigner(s)
 		if err != nil {
-			fatal("new signer", "err", err)
+			conn.Close()
+			return nil, err
 		}
+		ss.conn = conn
 		if ssh.FingerprintSHA256(s.PublicKey()) == *keyFlag {
-			signer = ss
-			break
+			return ss, nil
 		}
 		// For backwards compatibility, also accept a hex-encoded SHA-256 hash
 		// of the public key, which is what -key used to be.
 		hh := sha256.Sum256(ss.Public().(ed25519.PublicKey))
 		h := hex.EncodeToString(hh[:])
 		if h == *keyFlag {
-			signer = ss
-			break
+			return ss, nil
 		}
 		keys = append(keys, h)
 	}
-	if signer == nil {
-		fatal("ssh-agent does not contain Ed25519 key", "expected", *keyFlag, "found", keys)
-	}
-	slog.Info("found key", "fingerprint", *keyFlag)
-	return signer
+	conn.Close()
+	return nil, fmt.Errorf("ssh-agent does not contain Ed25519 key %q (found %q)", *keyFlag, keys)
 }
 
 type signer struct {
-	s ssh.Signer
 	p ed25519.PublicKey
+
+	// mu protects s and conn, which are replaced if the ssh-agent connection
+	// needs to be re-established. conn is nil if the key is from -key-file.
+	mu   sync.Mutex
+	s    ssh.Signer
+	conn net.Conn
 }
 
 func newSigner(s ssh.Signer) (*signer, error) {
@@ -187,17 +354,55 @@ func (s *signer) Public() crypto.PublicKey {
 	return s.p
 }
 
+// Sign signs data with the witness key. If signing with the ssh-agent fails,
+// for example because the agent was restarted, Sign reconnects to the agent and
+// retries once.
 func (s *signer) Sign(rand io.Reader, data []byte, opts crypto.SignerOpts) (signature []byte, err error) {
 	if opts.HashFunc() != crypto.Hash(0) {
 		return nil, errors.New("expected crypto.Hash(0)")
 	}
-	sig, err := s.s.Sign(rand, data)
+	s.mu.Lock()
+	ss, fromAgent := s.s, s.conn != nil
+	s.mu.Unlock()
+	sig, err := ss.Sign(rand, data)
+	if err != nil && fromAgent {
+		slog.Info("ssh-agent signing failed, reconnecting", "err", err)
+		ss, err = s.reconnect(ss)
+		if err != nil {
+			return nil, err
+		}
+		sig, err = ss.Sign(rand, data)
+	}
 	if err != nil {
 		return nil, err
 	}
 	return sig.Blob, nil
 }
 
+// reconnect re-dials the ssh-agent, unless another goroutine already replaced
+// the failed ssh.Signer, and returns the new ssh.Signer.
+func (s *signer) reconnect(failed ssh.Signer) (ssh.Signer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.s != failed {
+		return s.s, nil
+	}
+	ss, err := dialSSHAgent()
+	if err != nil {
+		return nil, fmt.Errorf("reconnecting to ssh-agent: %w", err)
+	}
+	if !ss.p.Equal(s.p) {
+		ss.conn.Close()
+		return nil, errors.New("reconnecting to ssh-agent: key changed")
+	}
+	slog.Info("reconnected to ssh-agent", "addr", *sshAgentFlag)
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.s, s.conn = ss.s, ss.conn
+	return s.s, nil
+}
+
 const indexHeader = `
 <!DOCTYPE html>
 <title>litewitness</title>
@@ -218,9 +423,15 @@ pre {
 <pre>
 `
 
-func indexHandler(w *witness.Witness) http.HandlerFunc {
+func indexHandler(w *witness.Witness, signer *signer) http.HandlerFunc {
+	start := time.Now()
+	pk, err := ssh.NewPublicKey(signer.p)
+	if err != nil {
+		fatal("encoding public key", "err", err)
+	}
+	fingerprint := ssh.FingerprintSHA256(pk)
 	return func(rw http.ResponseWriter, r *http.Request) {
-		db, err := witness.OpenDB(*dbFlag)
+		db, err := witness.OpenDB(r.Context(), *dbFlag)
 		if err != nil {
 			http.Error(rw, "internal error", http.StatusInternalServerError)
 			return
@@ -231,22 +442,42 @@ func indexHandler(w *witness.Witness) http.HandlerFunc {
 		io.WriteString(rw, indexHeader)
 		fmt.Fprintf(rw, "# litewitness %s\n\n", html.EscapeString(*nameFlag))
 		fmt.Fprintf(rw, "%s\n\n", html.EscapeString(w.VerifierKey()))
+		fmt.Fprintf(rw, "Key fingerprint: %s\n", fingerprint)
+		fmt.Fprintf(rw, "Uptime: %s\n\n", time.Since(start).Round(time.Second))
 		fmt.Fprintf(rw, "## Logs\n\n")
-		sqlitex.Exec(db, "SELECT origin, tree_size, tree_hash FROM log",
+		sqlitex.Exec(db, "SELECT origin, tree_size, tree_hash, last_updated FROM log",
 			func(stmt *sqlite.Stmt) error {
-				fmt.Fprintf(rw, "- %s\n  (size %d, root %s)\n\n",
+				updated := "never"
+				if stmt.ColumnType(3) != sqlite.SQLITE_NULL {
+					updated = time.Unix(stmt.ColumnInt64(3), 0).UTC().Format(time.RFC3339)
+				}
+				fmt.Fprintf(rw, "- %s\n  (size %d, root %s)\n  last updated %s\n\n",
 					html.EscapeString(stmt.ColumnText(0)),
-					stmt.ColumnInt64(1), stmt.ColumnText(2))
+					stmt.ColumnInt64(1), stmt.ColumnText(2), updated)
 				return nil
 			},
 		)
 	}
 }
 
+func metricsHandler(w *witness.Witness) http.HandlerFunc {
+	// Label values are escaped per the Prometheus text exposition format.
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		io.WriteString(rw, "# HELP litewitness_add_checkpoint_requests_total Add-checkpoint requests by log origin and outcome.\n")
+		io.WriteString(rw, "# TYPE litewitness_add_checkpoint_requests_total counter\n")
+		for _, c := range w.RequestCounts() {
+			fmt.Fprintf(rw, "litewitness_add_checkpoint_requests_total{origin=\"%s\",outcome=\"%s\"} %d\n",
+				escape.Replace(c.Origin), c.Outcome, c.Count)
+		}
+	}
+}
+
 var errBastionDisconnected = errors.New("connection to bastion interrupted")
 
-func connectToBastion(ctx context.Context, bastion string, signer *signer, srv *http.Server) error {
-	slog.Info("connecting to bastion", "bastion", bastion)
+func connectToBastion(ctx context.Context, bastion string, signer *signer, srv *http.Server, h http.Handler) error {
+	slog.Debug("connecting to bastion", "bastion", bastion)
 	cert, err := selfSignedCertificate(signer)
 	if err != nil {
 		fatal("generating self-signed certificate", "err", err)
@@ -278,21 +509,66 @@ func connectToBastion(ctx context.Context, bastion string, signer *signer, srv *
 		slog.Info("connecting to bastion failed", "bastion", bastion, "err", err)
 		return fmt.Errorf("connecting to bastion: %v", err)
 	}
-	slog.Info("connected to bastion", "bastion", bastion)
-	// TODO: find a way to surface the fatal error, especially since with
-	// TLS 1.3 it might be that the bastion rejected the client certificate.
+	// With TLS 1.3, the client certificate is sent after the handshake
+	// completes from our point of view, so if the bastion rejects it we only
+	// find out from the alert returned by the first Read. Conversely, a
+	// successful first Read means the bastion accepted us.
+	rc := &readErrConn{Conn: conn.(*tls.Conn), accepted: func() {
+		slog.Info("serving through bastion", "bastion", bastion)
+		markReady()
+	}}
 	(&http2.Server{
 		CountError: func(errType string) {
 			slog.Debug("HTTP/2 server error", "type", errType)
 		},
-	}).ServeConn(conn, &http2.ServeConnOpts{
+	}).ServeConn(rc, &http2.ServeConnOpts{
 		Context:    ctx,
 		BaseConfig: srv,
-		Handler:    srv.Handler,
+		Handler:    h,
 	})
+	if err := rc.firstReadErr(); err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "remote error" {
+			slog.Error("bastion rejected our key, is it in the backends file?",
+				"bastion", bastion, "err", err)
+			return fmt.Errorf("bastion rejected our key: %w", err)
+		}
+	}
 	return errBastionDisconnected
 }
 
+// readErrConn records the error returned by the first Read, if any, and calls
+// accepted if the first Read succeeds.
+type readErrConn struct {
+	*tls.Conn
+	accepted func()
+
+	mu   sync.Mutex
+	read bool
+	err  error
+}
+
+func (c *readErrConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	first := !c.read
+	if first {
+		c.read = true
+		c.err = err
+	}
+	c.mu.Unlock()
+	if first && err == nil {
+		c.accepted()
+	}
+	return n, err
+}
+
+func (c *readErrConn) firstReadErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
 func selfSignedCertificate(key crypto.Signer) ([]byte, error) {
 	tmpl := &x509.Certificate{
 		SerialNumber: big.NewInt(1),
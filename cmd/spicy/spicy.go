@@ -24,8 +24,17 @@ func main() {
 		"initialize a new log with the given name (e.g. example.com/spicy)")
 	assetsFlag := flag.String("assets", "",
 		"directory where log entries and metadata are stored")
+	sigdirFlag := flag.String("sigdir", "",
+		"directory where spicy signatures are written or read (default: next to each file)")
 	flag.Parse()
 
+	sigPath := func(path string) string {
+		if *sigdirFlag == "" {
+			return path + ".spicy"
+		}
+		return filepath.Join(*sigdirFlag, filepath.Base(path)+".spicy")
+	}
+
 	if *verifyFlag != "" {
 		if len(flag.Args()) == 0 {
 			log.Fatalf("no files to verify")
@@ -39,9 +48,9 @@ func main() {
 			if err != nil {
 				log.Fatalf("could not read %q: %v", path, err)
 			}
-			sig, err := os.ReadFile(path + ".spicy")
+			sig, err := os.ReadFile(sigPath(path))
 			if err != nil {
-				log.Fatalf("could not read %q: %v", path+".spicy", err)
+				log.Fatalf("could not read %q: %v", sigPath(path), err)
 			}
 			s := string(sig)
 			s, ok := strings.CutPrefix(s, "index ")
@@ -72,16 +81,9 @@ func main() {
 				}
 				proof = append(proof, hh)
 			}
-			m, err := note.Open([]byte(s), note.VerifierList(vkey))
+			c, err := tlogx.ParseAndVerifyCheckpoint([]byte(s), vkey)
 			if err != nil {
-				log.Fatalf("could not verify checkpoint for %q: %v", path, err)
-			}
-			c, err := tlogx.ParseCheckpoint(m.Text)
-			if err != nil {
-				log.Fatalf("could not parse checkpoint for %q: %v", path, err)
-			}
-			if c.Origin != vkey.Name() {
-				log.Fatalf("spicy signature for %q is for a different log: got %q, want %q", path, c.Origin, vkey.Name())
+				log.Fatalf("invalid spicy signature for %q: %v", path, err)
 			}
 			if err := tlog.CheckRecord(proof, c.N, c.Hash, index, tlog.RecordHash(f)); err != nil {
 				log.Fatalf("could not verify inclusion for %q: %v", path, err)
@@ -92,13 +94,11 @@ func main() {
 	}
 
 	if *initFlag != "" {
-		latestPath := filepath.Join(*assetsFlag, "latest")
-		if _, err := os.Stat(latestPath); err == nil {
-			log.Fatalf("log already initialized, %q exists", latestPath)
-		}
-		edgePath := filepath.Join(*assetsFlag, "edge")
-		if _, err := os.Stat(edgePath); err == nil {
-			log.Fatalf("log already initialized, %q exists", edgePath)
+		for _, name := range []string{"latest", "edge"} {
+			path := filepath.Join(*assetsFlag, name)
+			if _, err := os.Stat(path); err == nil {
+				log.Fatalf("log already initialized, %q exists", path)
+			}
 		}
 		if _, err := os.Stat(*keyFlag); err == nil {
 			log.Fatalf("log already initialized, %q exists", *keyFlag)
@@ -112,23 +112,12 @@ func main() {
 		if err != nil {
 			log.Fatalf("could not create signer: %v", err)
 		}
-		checkpoint, err := note.Sign(&note.Note{
-			Text: tlogx.FormatCheckpoint(tlogx.Checkpoint{
-				Origin: *initFlag,
-			}),
-		}, signer)
-		if err != nil {
-			log.Fatalf("could not sign checkpoint: %v", err)
-		}
 
 		if err := os.WriteFile(*keyFlag, []byte(skey), 0600); err != nil {
 			log.Fatalf("could not write key: %v", err)
 		}
-		if err := os.WriteFile(latestPath, checkpoint, 0644); err != nil {
-			log.Fatalf("could not write latest checkpoint: %v", err)
-		}
-		if err := os.WriteFile(edgePath, []byte("size 0\n"), 0644); err != nil {
-			log.Fatalf("could not write edge: %v", err)
+		if _, err := tlogx.CreateLog(*assetsFlag, signer); err != nil {
+			log.Fatalf("could not initialize log: %v", err)
 		}
 
 		fmt.Fprintf(os.Stderr, "Log initialized! 🌶️\n")
@@ -156,131 +145,51 @@ func main() {
 		log.Fatalf("could not create verifier: %v", err)
 	}
 
-	checkpoint, err := os.ReadFile(filepath.Join(*assetsFlag, "latest"))
-	if err != nil {
-		log.Fatalf("could not read latest checkpoint: %v", err)
-	}
-	n, err := note.Open(checkpoint, note.VerifierList(verifier))
+	l, err := tlogx.OpenLog(*assetsFlag, signer, verifier)
 	if err != nil {
-		log.Fatalf("could not verify latest checkpoint: %v", err)
-	}
-	c, err := tlogx.ParseCheckpoint(n.Text)
-	if err != nil {
-		log.Fatalf("could not parse latest checkpoint: %v", err)
-	}
-
-	hashes := make(map[int64]tlog.Hash)
-	hashReader := tlog.HashReaderFunc(func(indexes []int64) ([]tlog.Hash, error) {
-		list := make([]tlog.Hash, 0, len(indexes))
-		for _, id := range indexes {
-			h, ok := hashes[id]
-			if !ok {
-				return nil, fmt.Errorf("index %d not in hashes", id)
-			}
-			list = append(list, h)
-		}
-		return list, nil
-	})
-
-	edge, err := os.ReadFile(filepath.Join(*assetsFlag, "edge"))
-	if err != nil {
-		log.Fatalf("could not open edge file: %v", err)
-	}
-	lines := strings.Split(strings.TrimSpace(string(edge)), "\n")
-	if len(lines) < 1 {
-		log.Fatalf("malformed edge file")
-	}
-	if size, ok := strings.CutPrefix(lines[0], "size "); !ok {
-		log.Fatalf("malformed edge file: %q", lines[0])
-	} else {
-		n, err := strconv.ParseInt(size, 10, 64)
-		if err != nil {
-			log.Fatalf("malformed edge file: %v", err)
-		}
-		if n != c.N {
-			log.Fatalf("edge file size mismatch: got %d, latest checkpoint is %d", n, c.N)
-		}
-	}
-	idx := tlogx.RightEdge(c.N)
-	if len(idx) != len(lines[1:]) {
-		log.Fatalf("edge hash count mismatch: got %d, want %d", len(lines[1:]), len(idx))
-	}
-	for i, line := range lines[1:] {
-		hash, err := tlog.ParseHash(line)
-		if err != nil {
-			log.Fatalf("malformed edge file: %v", err)
-		}
-		hashes[idx[i]] = hash
+		log.Fatalf("could not load log: %v", err)
 	}
 
 	fmt.Fprintf(os.Stderr, "Log loaded.\n")
-	fmt.Fprintf(os.Stderr, "  - Name: %s\n", c.Origin)
-	fmt.Fprintf(os.Stderr, "  - Current size: %d\n", c.N)
+	fmt.Fprintf(os.Stderr, "  - Name: %s\n", l.Origin())
+	fmt.Fprintf(os.Stderr, "  - Current size: %d\n", l.Tree().N)
 	fmt.Fprintf(os.Stderr, "  - Assets directory: %s\n", *assetsFlag)
 
-	for i, path := range flag.Args() {
-		if _, err := os.Stat(path + ".spicy"); err == nil {
+	sigPaths := make(map[string]string)
+	for _, path := range flag.Args() {
+		if _, err := os.Stat(sigPath(path)); err == nil {
 			log.Fatalf("spicy signature already exists for %q", path)
 		}
+		if other, ok := sigPaths[sigPath(path)]; ok {
+			log.Fatalf("%q and %q would have the same spicy signature path", other, path)
+		}
+		sigPaths[sigPath(path)] = path
+	}
+	var entries [][]byte
+	for _, path := range flag.Args() {
 		f, err := os.ReadFile(path)
 		if err != nil {
 			log.Fatalf("could not read %q: %v", path, err)
 		}
-		n := c.N + int64(i)
-		hh, err := tlog.StoredHashes(n, f, hashReader)
-		if err != nil {
-			log.Fatalf("could not append %q: %v", path, err)
-		}
-		for k, h := range hh {
-			hashes[tlog.StoredHashIndex(0, n)+int64(k)] = h
-		}
-		entryPath := filepath.Join(*assetsFlag, strconv.FormatInt(n, 10))
-		if err := os.WriteFile(entryPath, f, 0644); err != nil {
-			log.Fatalf("could not copy %q to assets: %v", path, err)
-		}
-		fmt.Fprintf(os.Stderr, "  + %q is now entry %d\n", path, n)
-	}
-
-	N := c.N + int64(len(flag.Args()))
-	th, err := tlog.TreeHash(N, hashReader)
-	if err != nil {
-		log.Fatalf("could not compute tree hash: %v", err)
+		entries = append(entries, f)
 	}
-	newCheckpoint, err := note.Sign(&note.Note{
-		Text: tlogx.FormatCheckpoint(tlogx.Checkpoint{
-			Origin: c.Origin,
-			Tree:   tlog.Tree{N: N, Hash: th},
-		})}, signer)
+	first, proofs, err := l.Append(entries...)
 	if err != nil {
-		log.Fatalf("could not sign new checkpoint: %v", err)
-	}
-	newEdge := fmt.Sprintf("size %d\n", N)
-	for _, idx := range tlogx.RightEdge(N) {
-		newEdge += fmt.Sprintf("%s\n", hashes[idx])
-	}
-
-	if err := os.WriteFile(filepath.Join(*assetsFlag, "latest"), newCheckpoint, 0644); err != nil {
-		log.Fatalf("could not write new checkpoint: %v", err)
-	}
-	if err := os.WriteFile(filepath.Join(*assetsFlag, "edge"), []byte(newEdge), 0644); err != nil {
-		log.Fatalf("could not write new edge: %v", err)
+		log.Fatalf("could not append entries: %v", err)
 	}
-	fmt.Fprintf(os.Stderr, "  - New size: %d\n", N)
-
 	for i, path := range flag.Args() {
-		s := fmt.Sprintf("index %d\n", c.N+int64(i))
-		proof, err := tlog.ProveRecord(N, c.N+int64(i), hashReader)
-		if err != nil {
-			log.Fatalf("could not prove record %d: %v", c.N+int64(i), err)
-		}
-		for _, p := range proof {
+		fmt.Fprintf(os.Stderr, "  + %q is now entry %d\n", path, first+int64(i))
+
+		s := fmt.Sprintf("index %d\n", first+int64(i))
+		for _, p := range proofs[i] {
 			s += fmt.Sprintf("%s\n", p)
 		}
 		s += "\n"
-		s += string(newCheckpoint)
-		if err := os.WriteFile(path+".spicy", []byte(s), 0644); err != nil {
+		s += string(l.Checkpoint())
+		if err := os.WriteFile(sigPath(path), []byte(s), 0644); err != nil {
 			log.Fatalf("could not write spicy signature: %v", err)
 		}
 	}
+	fmt.Fprintf(os.Stderr, "  - New size: %d\n", l.Tree().N)
 	fmt.Fprintf(os.Stderr, "Spicy signatures written! 🌶️\n")
 }
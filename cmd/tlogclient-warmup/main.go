@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
 
 	"filippo.io/litetlog/internal/tlogclient"
@@ -30,12 +34,24 @@ func main() {
 	dirCache := tlogclient.NewPermanentCache(fetcher, cacheDir)
 	client := tlogclient.NewClient(dirCache)
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
 	bar := pb.Start64(tree.N)
-	for range client.EntriesSumDB(tree, 0) {
-		bar.Increment()
-	}
+	err = tlogclient.Warmup(ctx, client, tree, func(done, total int64) {
+		bar.SetCurrent(done)
+	})
 	bar.Finish()
-	if err := client.Error(); err != nil {
+
+	stats := dirCache.Stats()
+	fmt.Fprintf(os.Stderr, "Cache hits: %d tiles (%d bytes)\n", stats.Hits, stats.HitBytes)
+	fmt.Fprintf(os.Stderr, "Cache misses: %d tiles (%d bytes fetched)\n", stats.Misses, stats.FetchedBytes)
+
+	if errors.Is(err, context.Canceled) {
+		fmt.Fprintln(os.Stderr, "Interrupted.")
+		os.Exit(1)
+	}
+	if err != nil {
 		panic(err)
 	}
 }
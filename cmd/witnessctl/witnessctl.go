@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"flag"
@@ -12,6 +13,7 @@ import (
 	"crawshaw.io/sqlite/sqlitex"
 	"filippo.io/litetlog/internal/witness"
 	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
 	sigsum "sigsum.org/sigsum-go/pkg/crypto"
 	"sigsum.org/sigsum-go/pkg/merkle"
 )
@@ -19,11 +21,13 @@ import (
 func usage() {
 	fmt.Printf("Usage: %s <command> [options]\n", os.Args[0])
 	fmt.Println("Commands:")
-	fmt.Println("    add-log -db <path> -origin <origin>")
+	fmt.Println("    add-log -db <path> -origin <origin> [-pin-size <size> -pin-hash <base64 hash>]")
 	fmt.Println("    add-key -db <path> -origin <origin> -key <verifier key>")
 	fmt.Println("    del-key -db <path> -origin <origin> -key <verifier key>")
+	fmt.Println("    rotate-key -db <path> -origin <origin> -old <verifier key> -new <verifier key>")
 	fmt.Println("    add-sigsum-log -db <path> -key <hex-encoded key>")
 	fmt.Println("    list-logs -db <path>")
+	fmt.Println("    get-checkpoint -db <path> -origin <origin>")
 	os.Exit(1)
 }
 
@@ -36,9 +40,27 @@ func main() {
 	switch os.Args[1] {
 	case "add-log":
 		originFlag := fs.String("origin", "", "log name")
+		pinSizeFlag := fs.Int64("pin-size", 0, "size of the required first tree head")
+		pinHashFlag := fs.String("pin-hash", "", "base64-encoded root hash of the required first tree head")
 		fs.Parse(os.Args[2:])
+		pin := *pinSizeFlag != 0 || *pinHashFlag != ""
+		var pinHash tlog.Hash
+		if pin {
+			if *pinSizeFlag <= 0 {
+				log.Fatal("Pinned size must be positive.")
+			}
+			h, err := tlog.ParseHash(*pinHashFlag)
+			if err != nil {
+				log.Fatalf("Error parsing pinned hash: %v", err)
+			}
+			pinHash = h
+		}
 		db := openDB(*dbFlag)
-		addLog(db, *originFlag)
+		if pin {
+			addPinnedLog(db, *originFlag, *pinSizeFlag, pinHash)
+		} else {
+			addLog(db, *originFlag)
+		}
 
 	case "add-key":
 		originFlag := fs.String("origin", "", "log name")
@@ -54,6 +76,14 @@ func main() {
 		db := openDB(*dbFlag)
 		delKey(db, *originFlag, *keyFlag)
 
+	case "rotate-key":
+		originFlag := fs.String("origin", "", "log name")
+		oldFlag := fs.String("old", "", "verifier key to remove")
+		newFlag := fs.String("new", "", "verifier key to add")
+		fs.Parse(os.Args[2:])
+		db := openDB(*dbFlag)
+		rotateKey(db, *originFlag, *oldFlag, *newFlag)
+
 	case "add-sigsum-log":
 		keyFlag := fs.String("key", "", "hex-encoded key")
 		fs.Parse(os.Args[2:])
@@ -65,13 +95,19 @@ func main() {
 		db := openDB(*dbFlag)
 		listLogs(db)
 
+	case "get-checkpoint":
+		originFlag := fs.String("origin", "", "log name")
+		fs.Parse(os.Args[2:])
+		db := openDB(*dbFlag)
+		getCheckpoint(db, *originFlag)
+
 	default:
 		usage()
 	}
 }
 
 func openDB(dbPath string) *sqlite.Conn {
-	db, err := witness.OpenDB(dbPath)
+	db, err := witness.OpenDB(context.Background(), dbPath)
 	if err != nil {
 		log.Fatalf("Error opening database: %v", err)
 	}
@@ -87,6 +123,27 @@ func addLog(db *sqlite.Conn, origin string) {
 	log.Printf("Added log %q.", origin)
 }
 
+func addPinnedLog(db *sqlite.Conn, origin string, size int64, h tlog.Hash) {
+	if err := insertPinnedLog(db, origin, size, h); err != nil {
+		log.Fatalf("Error adding log: %v", err)
+	}
+	log.Printf("Added log %q pinned to size %d and hash %s.", origin, size, h)
+}
+
+// insertPinnedLog adds the log and its pinned tree head in a single
+// transaction, so that the witness never sees the log without its pin.
+func insertPinnedLog(db *sqlite.Conn, origin string, size int64, h tlog.Hash) (err error) {
+	defer sqlitex.Save(db)(&err)
+	treeHash := merkle.HashEmptyTree()
+	err = sqlitex.Exec(db, "INSERT INTO log (origin, tree_size, tree_hash) VALUES (?, 0, ?)",
+		nil, origin, base64.StdEncoding.EncodeToString(treeHash[:]))
+	if err != nil {
+		return err
+	}
+	return sqlitex.Exec(db, "UPDATE log SET pinned_size = ?, pinned_hash = ? WHERE origin = ?",
+		nil, size, h.String(), origin)
+}
+
 func addKey(db *sqlite.Conn, origin string, vk string) {
 	v, err := note.NewVerifier(vk)
 	if err != nil {
@@ -113,6 +170,34 @@ func delKey(db *sqlite.Conn, origin string, vk string) {
 	log.Printf("Deleted key %q.", vk)
 }
 
+func rotateKey(db *sqlite.Conn, origin string, oldVK, newVK string) {
+	v, err := note.NewVerifier(newVK)
+	if err != nil {
+		log.Fatalf("Error parsing verifier key: %v", err)
+	}
+	if v.Name() != origin {
+		log.Fatalf("Verifier key name %q does not match origin %q.", v.Name(), origin)
+	}
+	if err := replaceKey(db, origin, oldVK, newVK); err != nil {
+		log.Fatalf("Error rotating key: %v", err)
+	}
+	log.Printf("Replaced key %q with %q.", oldVK, newVK)
+}
+
+// replaceKey deletes oldVK and adds newVK in a single transaction, so that
+// the witness never accepts both or neither.
+func replaceKey(db *sqlite.Conn, origin string, oldVK, newVK string) (err error) {
+	defer sqlitex.Save(db)(&err)
+	err = sqlitex.Exec(db, "DELETE FROM key WHERE origin = ? AND key = ?", nil, origin, oldVK)
+	if err != nil {
+		return err
+	}
+	if db.Changes() == 0 {
+		return fmt.Errorf("key %q not found", oldVK)
+	}
+	return sqlitex.Exec(db, "INSERT INTO key (origin, key) VALUES (?, ?)", nil, origin, newVK)
+}
+
 func addSigsumLog(db *sqlite.Conn, keyFlag string) {
 	if len(keyFlag) != sigsum.PublicKeySize*2 {
 		log.Fatal("Key must be 32 hex-encoded bytes.")
@@ -152,3 +237,18 @@ func listLogs(db *sqlite.Conn) {
 		log.Fatalf("Error listing logs: %v", err)
 	}
 }
+
+func getCheckpoint(db *sqlite.Conn, origin string) {
+	found := false
+	if err := sqlitex.Exec(db, "SELECT checkpoint FROM log WHERE origin = ? AND checkpoint IS NOT NULL",
+		func(stmt *sqlite.Stmt) error {
+			found = true
+			_, err := fmt.Print(stmt.ColumnText(0))
+			return err
+		}, origin); err != nil {
+		log.Fatalf("Error getting checkpoint: %v", err)
+	}
+	if !found {
+		log.Fatalf("No cosigned checkpoint found for log %q.", origin)
+	}
+}
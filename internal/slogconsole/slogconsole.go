@@ -1,9 +1,11 @@
 package slogconsole
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"log"
 	"log/slog"
 	"net/http"
 	"slices"
@@ -21,7 +23,9 @@ import (
 //
 // The slog Handler will accept all records (Enabled returns true) if there are
 // any web clients connected, and none otherwise. If a client is too slow to
-// consume records, they will be dropped.
+// consume records, the oldest ones that it didn't receive yet will be dropped.
+// If the records queued for all clients exceed a global memory budget (see
+// [Handler.SetMemoryLimit]), the slowest clients are disconnected.
 //
 // [server-sent events]: https://html.spec.whatwg.org/multipage/server-sent-events.html
 type Handler struct {
@@ -37,8 +41,25 @@ type Handler struct {
 // implementations. (Note how [slog.TextHandler] has to do the same thing.)
 type commonHandler struct {
 	mu      sync.RWMutex
-	clients []chan []byte
+	clients []*client
 	limit   int
+	buffer  int
+
+	// bmu protects queued, budget, and the queued field of each client. It
+	// can be acquired while holding mu, but not the other way around.
+	bmu    sync.Mutex
+	queued int
+	budget int
+}
+
+type client struct {
+	ch chan []byte
+	// queued is the size in bytes of the records in ch.
+	queued int
+	// shed is closed when the client is disconnected for being too slow.
+	shed chan struct{}
+	// removed is set once queued stops being counted in the total.
+	removed bool
 }
 
 var _ http.Handler = &Handler{}
@@ -55,7 +76,7 @@ func New(opts *slog.HandlerOptions) *Handler {
 	if opts.Level == nil {
 		opts.Level = slog.LevelDebug
 	}
-	h := &commonHandler{limit: 10}
+	h := &commonHandler{limit: 10, buffer: 10, budget: 1 << 20}
 	sh := slog.NewTextHandler(h, opts)
 	return &Handler{ch: h, sh: sh}
 }
@@ -87,16 +108,75 @@ func (h *commonHandler) Write(b []byte) (int, error) {
 	clients := h.clients
 	h.mu.RUnlock()
 
+	// The slog.TextHandler reuses its buffer after Write returns.
+	b = bytes.Clone(b)
 	for _, c := range clients {
 		select {
-		case c <- b:
+		case c.ch <- b:
+			h.account(c, len(b))
+			continue
+		default:
+		}
+		// The client is too slow. Drop its oldest queued record to make room,
+		// so that the tail stays current. Never block, even if another Write
+		// raced us to the free slot.
+		select {
+		case old := <-c.ch:
+			h.account(c, -len(old))
+		default:
+		}
+		select {
+		case c.ch <- b:
+			h.account(c, len(b))
 		default:
 		}
 	}
 
+	h.bmu.Lock()
+	over := h.budget > 0 && h.queued > h.budget
+	h.bmu.Unlock()
+	if over {
+		h.shedSlowClients()
+	}
+
 	return len(b), nil
 }
 
+// account records that n bytes were added to (or removed from, if negative)
+// the queue of c.
+func (h *commonHandler) account(c *client, n int) {
+	h.bmu.Lock()
+	defer h.bmu.Unlock()
+	if c.removed {
+		// Already subtracted from the total.
+		return
+	}
+	c.queued += n
+	h.queued += n
+}
+
+// shedSlowClients disconnects the clients with the most queued bytes until
+// the total is within the memory budget.
+func (h *commonHandler) shedSlowClients() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.bmu.Lock()
+	defer h.bmu.Unlock()
+	for h.budget > 0 && h.queued > h.budget && len(h.clients) > 0 {
+		slowest := h.clients[0]
+		for _, c := range h.clients[1:] {
+			if c.queued > slowest.queued {
+				slowest = c
+			}
+		}
+		h.queued -= slowest.queued
+		slowest.queued = 0
+		slowest.removed = true
+		close(slowest.shed)
+		h.clients = slices.DeleteFunc(h.clients, func(c *client) bool { return c == slowest })
+	}
+}
+
 // SetLimit sets the maximum number of clients that can connect to the handler.
 // If the limit is reached, new clients will receive a 503 Service Unavailable
 // response.
@@ -108,6 +188,44 @@ func (h *Handler) SetLimit(limit int) {
 	h.ch.limit = limit
 }
 
+// SetClientBuffer sets the number of records that can be queued for each
+// client before the oldest ones start being dropped. It only applies to
+// clients that connect after the call.
+//
+// The memory used for buffering is at most the buffer size, times the client
+// limit (see [Handler.SetLimit]), times the maximum size of a record, and it's
+// further bounded by [Handler.SetMemoryLimit].
+//
+// The default buffer size is 10.
+func (h *Handler) SetClientBuffer(n int) {
+	h.ch.mu.Lock()
+	defer h.ch.mu.Unlock()
+	h.ch.buffer = n
+}
+
+// SetMemoryLimit sets the maximum total size in bytes of the records queued
+// for all clients. If it's exceeded, the clients with the most queued bytes
+// are sent a final "disconnected: too slow" event and disconnected, until the
+// total is within the limit again. A limit of zero disables the check.
+//
+// The default limit is 1 MiB.
+func (h *Handler) SetMemoryLimit(n int) {
+	h.ch.bmu.Lock()
+	defer h.ch.bmu.Unlock()
+	h.ch.budget = n
+}
+
+// LogLogger returns a [log.Logger] that emits a record at the given level to
+// h for each line it logs, for example to use as the ErrorLog of an
+// [http.Server] or [net/http/httputil.ReverseProxy].
+//
+// Like for any other record, lines are dropped if there are no web clients
+// connected. To also send them to other handlers, use [slog.NewLogLogger]
+// with a [MultiHandler] instead.
+func (h *Handler) LogLogger(level slog.Level) *log.Logger {
+	return slog.NewLogLogger(h, level)
+}
+
 // ServeHTTP implements [http.Handler].
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	accept := strings.Split(r.Header.Get("Accept"), ",")
@@ -133,19 +251,24 @@ func (h *commonHandler) serveSSE(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	rc.Flush()
 
-	ch := make(chan []byte, 10)
 	h.mu.Lock()
 	if len(h.clients) > h.limit {
 		h.mu.Unlock()
 		http.Error(w, "too many clients", http.StatusServiceUnavailable)
 		return
 	}
-	h.clients = append(h.clients, ch)
+	c := &client{ch: make(chan []byte, h.buffer), shed: make(chan struct{})}
+	h.clients = append(h.clients, c)
 	h.mu.Unlock()
 	defer func() {
 		h.mu.Lock()
 		defer h.mu.Unlock()
-		h.clients = slices.DeleteFunc(h.clients, func(c chan []byte) bool { return c == ch })
+		h.clients = slices.DeleteFunc(h.clients, func(cc *client) bool { return cc == c })
+		h.bmu.Lock()
+		defer h.bmu.Unlock()
+		h.queued -= c.queued
+		c.queued = 0
+		c.removed = true
 	}()
 
 	// Override the default strict deadline, but force the client to reconnect
@@ -154,13 +277,18 @@ func (h *commonHandler) serveSSE(w http.ResponseWriter, r *http.Request) {
 
 	for {
 		select {
-		case b := <-ch:
+		case b := <-c.ch:
+			h.account(c, -len(b))
 			// Note that TextHandler promises "a single line" "in a single
 			// serialized call to io.Writer.Write" for each Record.
 			if _, err := fmt.Fprintf(w, "data: %s\n", b); err != nil {
 				return
 			}
 			rc.Flush()
+		case <-c.shed:
+			fmt.Fprintf(w, "data: disconnected: too slow\n\n")
+			rc.Flush()
+			return
 		case <-r.Context().Done():
 			return
 		}
@@ -2,30 +2,93 @@ package tlogclient
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"iter"
 	"log/slog"
+	"math/bits"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"filippo.io/litetlog/internal/tlogx"
+	"golang.org/x/mod/sumdb/note"
 	"golang.org/x/mod/sumdb/tlog"
 	"golang.org/x/sync/errgroup"
 )
 
+// tileHeight is the default tile height of a TileFetcher, used by the Go
+// Checksum Database and by tlog-tiles logs.
 const tileHeight = 8
-const tileWidth = 1 << tileHeight
 
 type Client struct {
+	tr   tlog.TileReader
+	err  error
+	hook func(tile tlog.Tile, index int64, got, want tlog.Hash, entry []byte)
+	pos  int64
+
+	includePartial bool
+	hashReader     func(ctx context.Context, tree tlog.Tree) tlog.HashReader
+	batchTimeout   time.Duration
+	audit          func(index int64, err error) bool
+	auditErrs      []error
+}
+
+// TileReaderWithContext is a [tlog.TileReader] that can also be canceled
+// through a context. The ReadTiles method must be equivalent to calling
+// ReadTilesContext with [context.Background].
+type TileReaderWithContext interface {
+	tlog.TileReader
+	ReadTilesContext(ctx context.Context, tiles []tlog.Tile) (data [][]byte, err error)
+}
+
+// TileHashReaderWithContext is like [tlog.TileHashReader], but it passes ctx
+// to tr.ReadTilesContext if tr implements [TileReaderWithContext].
+func TileHashReaderWithContext(ctx context.Context, tree tlog.Tree, tr tlog.TileReader) tlog.HashReader {
+	return tlog.TileHashReader(tree, &contextTileReader{ctx: ctx, tr: tr})
+}
+
+// contextTileReader binds a context to a TileReader.
+type contextTileReader struct {
+	ctx context.Context
 	tr  tlog.TileReader
-	err error
 }
 
+func (r *contextTileReader) Height() int {
+	return r.tr.Height()
+}
+
+func (r *contextTileReader) ReadTiles(tiles []tlog.Tile) (data [][]byte, err error) {
+	return readTiles(r.ctx, r.tr, tiles)
+}
+
+func (r *contextTileReader) SaveTiles(tiles []tlog.Tile, data [][]byte) {
+	r.tr.SaveTiles(tiles, data)
+}
+
+func readTiles(ctx context.Context, tr tlog.TileReader, tiles []tlog.Tile) (data [][]byte, err error) {
+	if tr, ok := tr.(TileReaderWithContext); ok {
+		return tr.ReadTilesContext(ctx, tiles)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return tr.ReadTiles(tiles)
+}
+
+// NewClient returns a new Client that fetches tiles from tr. The tile height
+// of the log is taken from tr.Height().
 func NewClient(tr tlog.TileReader) *Client {
 	// edgeMemoryCache keeps track of two edges: the rightmost one that's used
 	// to compute the tree hash, and the one that moves through the tree as we
@@ -34,15 +97,192 @@ func NewClient(tr tlog.TileReader) *Client {
 	return &Client{tr: tr}
 }
 
+// ClientStats are the counters of a [Client], returned by [Client.Stats].
+type ClientStats struct {
+	// Tiles is the number of tiles read by the Client, including hash tiles,
+	// and Bytes is their total size. Each tile is counted again every time
+	// it's read.
+	Tiles, Bytes int64
+
+	// MemoryHits is the number of tiles served from the Client's own memory
+	// cache of the edges of the tree.
+	MemoryHits int64
+
+	// CacheHits is the number of tiles loaded from disk, and CacheBytes is
+	// their size, if the Client was created with a [PermanentCache].
+	CacheHits, CacheBytes int64
+
+	// Fetched is the number of tiles read from the TileReader the Client was
+	// created with (or from the one underlying it, if it's a PermanentCache),
+	// and FetchedBytes is their size. Usually, this is network traffic.
+	Fetched, FetchedBytes int64
+}
+
+// Stats returns the counters of the Client since it was created.
+//
+// Like the rest of the Client, it must not be called concurrently with an
+// iteration.
+func (c *Client) Stats() ClientStats {
+	return c.tr.(*edgeMemoryCache).stats
+}
+
 func (c *Client) Error() error {
+	if len(c.auditErrs) > 0 {
+		return errors.Join(append([]error{c.err}, c.auditErrs...)...)
+	}
 	return c.err
 }
 
-func (c *Client) EntriesSumDB(tree tlog.Tree, start int64) iter.Seq2[int64, []byte] {
+// SetAuditMode sets a function that is called with the index and error of
+// each verification failure, such as a [VerificationError], [ErrLeftoverData],
+// or [ErrUnexpectedEndOfTile]. If it returns true, the failure is recorded and
+// iteration continues, skipping the affected entries. Otherwise, iteration
+// stops as usual.
+//
+// Recorded failures are joined with any other error in the value returned by
+// [Client.Error], but they don't prevent further iteration. Tiles with
+// recorded failures are not saved to the TileReader. This is meant for
+// auditors enumerating all the discrepancies of a suspect log. Since failures
+// are accumulated in memory, the function should eventually return false if
+// there are too many.
+func (c *Client) SetAuditMode(f func(index int64, err error) bool) {
+	c.audit = f
+}
+
+// SetIncludePartial sets whether the trailing partial tile is always fetched,
+// so that iteration reaches the end of the tree.
+//
+// By default, the trailing partial tile is only fetched if start is inside it,
+// to avoid fetching it repeatedly when following a growing log. Including it
+// is useful for one-shot jobs that need all the entries of a tree.
+func (c *Client) SetIncludePartial(include bool) {
+	c.includePartial = include
+}
+
+// Position returns the index following the last entry yielded by the last
+// call to [Client.EntriesSumDB] or [Client.EntriesFromCheckpoint], or the
+// start argument of that call if no entries were yielded. Entries skipped in
+// audit mode (see [Client.SetAuditMode]) count as yielded.
+//
+// Since the trailing partial tile is usually skipped, Position might be less
+// than the tree size even if iteration completed. Passing Position as start to
+// the next call resumes iteration right after the last yielded entry.
+func (c *Client) Position() int64 {
+	return c.pos
+}
+
+// SetBatchTimeout sets a timeout for fetching and verifying each batch of
+// tiles, rather than for the whole iteration. If a batch takes longer,
+// iteration stops and [Client.Error] returns an error wrapping
+// [ErrBatchTimeout]. The TileReader must implement [TileReaderWithContext]
+// for in-flight fetches to be interrupted.
+//
+// By default, or if d is zero, there is no per-batch timeout.
+func (c *Client) SetBatchTimeout(d time.Duration) {
+	c.batchTimeout = d
+}
+
+// ErrBatchTimeout is wrapped by the error returned by [Client.Error] if a batch
+// of tiles took longer than the timeout set with [Client.SetBatchTimeout].
+var ErrBatchTimeout = errors.New("timeout fetching batch of tiles")
+
+// SetHashReader sets a function that returns the [tlog.HashReader] used to
+// verify entries against tree, instead of the default one which reads and
+// verifies hash tiles from the TileReader.
+//
+// This is an advanced hook for callers that already maintain their own store
+// of verified hashes. The returned HashReader is trusted: it must only return
+// hashes that were verified to be part of tree. Only hashes of complete
+// subtrees are requested, so they don't change as the tree grows.
+func (c *Client) SetHashReader(f func(ctx context.Context, tree tlog.Tree) tlog.HashReader) {
+	c.hashReader = f
+}
+
+// SetVerifiedTilesHook sets a function that is called with the raw contents of
+// data and hash tiles after they have been verified against the tree, before
+// the entries they contain are yielded.
+//
+// Each tile is usually passed to hook only once, but the same tile might be
+// passed again if it needs to be fetched again. Tiles are identified by their
+// sumdb path, so writing each tile at filepath.Join(dir, tile.Path()) builds a
+// verified mirror that can be served to a [TileFetcher]. To mirror a log up to
+// a known size, use [Warmup] with [Client.SetIncludePartial].
+//
+// Hash tiles are not fetched, and not passed to hook, if a custom HashReader
+// was set with [Client.SetHashReader].
+func (c *Client) SetVerifiedTilesHook(hook func(tiles []tlog.Tile, data [][]byte)) {
+	c.tr.(*edgeMemoryCache).saved = hook
+}
+
+// SetVerificationFailureHook sets a function that is called when a data tile
+// fails verification, right before iteration stops.
+//
+// If the record hash of an entry doesn't match the tree, hook is called with
+// the tile, the index and contents of the entry, the hash of the entry, and
+// the expected hash. If there is leftover data at the end of a tile, hook is
+// called with index set to the index following the last entry of the tile,
+// zero hashes, and the leftover data as the entry.
+//
+// The hook is meant for diagnostics, and doesn't affect iteration: the error
+// is still reported by [Client.Error].
+func (c *Client) SetVerificationFailureHook(hook func(tile tlog.Tile, index int64, got, want tlog.Hash, entry []byte)) {
+	c.hook = hook
+}
+
+// ErrTileMismatch is wrapped by the [VerificationError] returned by
+// [Client.Error] if the entries of a full data tile don't hash to the
+// corresponding node of the hash tiles. This might indicate that the data and
+// hash tiles were served from different views of a forked log.
+var ErrTileMismatch = errors.New("data tile doesn't match the hash tiles")
+
+// A VerificationError is returned by [Client.Error] if an entry doesn't match
+// the tree.
+type VerificationError struct {
+	// Tile is the data tile that failed verification.
+	Tile tlog.Tile
+	// Index is the index of the first entry that doesn't match.
+	Index int64
+	// Err is ErrTileMismatch if the whole tile was checked against the hash
+	// tiles, or nil.
+	Err error
+}
+
+func (e *VerificationError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%v: %s", e.Err, e.Tile.Path())
+	}
+	return fmt.Sprintf("hash mismatch for entry %d", e.Index)
+}
+
+func (e *VerificationError) Unwrap() error {
+	return e.Err
+}
+
+// ErrLeftoverData is returned by [Client.Error] if a data tile has data after
+// its last entry.
+var ErrLeftoverData = errors.New("unexpected leftover data in tile")
+
+// ErrUnexpectedEndOfTile is returned by [Client.Error] if a data tile has fewer
+// entries than its width.
+var ErrUnexpectedEndOfTile = errors.New("unexpected end of tile data")
+
+// ErrTreeShrunk is returned by [Client.Error] if EntriesSumDB was called with a
+// tree smaller than start. This might indicate that the tree was obtained from
+// a log presenting a split view or that was rolled back.
+var ErrTreeShrunk = errors.New("tree is smaller than the requested start")
+
+func (c *Client) EntriesSumDB(ctx context.Context, tree tlog.Tree, start int64) iter.Seq2[int64, []byte] {
 	return func(yield func(int64, []byte) bool) {
 		if c.err != nil {
 			return
 		}
+		if tree.N < start {
+			c.err = fmt.Errorf("%w: tree size %d, start %d", ErrTreeShrunk, tree.N, start)
+			return
+		}
+		c.pos = start
+		height := c.tr.Height()
+		tileWidth := int64(1) << height
 		for {
 			base := start / tileWidth * tileWidth
 			// In regular operations, don't actually fetch the trailing partial
@@ -52,7 +292,7 @@ func (c *Client) EntriesSumDB(tree tlog.Tree, start int64) iter.Seq2[int64, []by
 			// slowly, we'll get another call where start is at the beginning of
 			// the partial tile; in that case, fetch it.
 			top := tree.N / tileWidth * tileWidth
-			if top-base == 0 {
+			if top-base == 0 || c.includePartial {
 				top = tree.N
 			}
 			tiles := make([]tlog.Tile, 0, 50)
@@ -65,26 +305,287 @@ func (c *Client) EntriesSumDB(tree tlog.Tree, start int64) iter.Seq2[int64, []by
 				if tileEnd > top {
 					tileEnd = top
 				}
-				tiles = append(tiles, tlog.Tile{H: tileHeight, L: -1,
+				tiles = append(tiles, tlog.Tile{H: height, L: -1,
 					N: tileStart / tileWidth, W: int(tileEnd - tileStart)})
 			}
 			if len(tiles) == 0 {
 				return
 			}
-			tdata, err := c.tr.ReadTiles(tiles)
+			entries, err := c.readEntryTiles(ctx, tree, tiles)
 			if err != nil {
 				c.err = err
 				return
 			}
 
-			// TODO: hash data tile directly against level 8 hash.
-			indexes := make([]int64, 0, tileWidth*len(tiles))
-			for _, t := range tiles {
-				for i := range t.W {
-					indexes = append(indexes, tlog.StoredHashIndex(0, t.N*tileWidth+int64(i)))
+			for ti, t := range tiles {
+				tileStart := t.N * tileWidth
+				for j, entry := range entries[ti] {
+					i := tileStart + int64(j)
+					if i < start {
+						continue
+					}
+					c.pos = i + 1
+					if entry == nil {
+						continue // skipped in audit mode
+					}
+					if !yield(i, entry) {
+						return
+					}
+				}
+				start = tileStart + int64(t.W)
+			}
+
+			if start == top {
+				return
+			}
+		}
+	}
+}
+
+// Warmup iterates over all the entries of tree, for example to populate a
+// [PermanentCache] under client. The trailing partial tile is skipped, like in
+// [Client.EntriesSumDB], unless [Client.SetIncludePartial] was called.
+//
+// If progress is not nil, it's called after each entry with the number of
+// entries processed so far and the tree size. Warmup returns when all entries
+// were processed, ctx is canceled, or an error occurs.
+func Warmup(ctx context.Context, client *Client, tree tlog.Tree, progress func(done, total int64)) error {
+	var done int64
+	for range client.EntriesSumDB(ctx, tree, 0) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		done++
+		if progress != nil {
+			progress(done, tree.N)
+		}
+	}
+	return client.Error()
+}
+
+// EntriesFromCheckpoint is like EntriesSumDB, but it takes a signed checkpoint
+// note, and verifies it with verifier before iterating over the entries of
+// its tree with [tlogx.ParseAndVerifyCheckpoint]. If the note can't be verified
+// or parsed, no entries are yielded and [Client.Error] returns the error.
+//
+// The checkpoint origin must match the verifier name. For logs where they
+// differ, like the Go Checksum Database, use [note.Open] and
+// [tlogx.ParseCheckpoint], and then [Client.EntriesSumDB].
+func (c *Client) EntriesFromCheckpoint(ctx context.Context, signedNote []byte, verifier note.Verifier, start int64) iter.Seq2[int64, []byte] {
+	return func(yield func(int64, []byte) bool) {
+		if c.err != nil {
+			return
+		}
+		cp, err := tlogx.ParseAndVerifyCheckpoint(signedNote, verifier)
+		if err != nil {
+			c.err = err
+			return
+		}
+		c.EntriesSumDB(ctx, cp.Tree, start)(yield)
+	}
+}
+
+// Tail follows a growing log, yielding its entries starting at start.
+//
+// It repeatedly calls fetchCheckpoint to obtain the latest verified tree, for
+// example by fetching and verifying a checkpoint, checks it's consistent with
+// the previous one with [Client.VerifyConsistency], and yields any new
+// entries. When there are no new entries, it waits before polling again,
+// backing off from one second to one minute.
+//
+// Iteration stops when ctx is canceled, when the consumer stops it, or when an
+// error occurs, which is then returned by [Client.Error]. The trailing partial
+// tile is handled like in [Client.EntriesSumDB], so entries in it might be
+// yielded one poll later than they appear in a tree.
+func (c *Client) Tail(ctx context.Context, fetchCheckpoint func(ctx context.Context) (tlog.Tree, error), start int64) iter.Seq2[int64, []byte] {
+	const minDelay, maxDelay = 1 * time.Second, 1 * time.Minute
+	return func(yield func(int64, []byte) bool) {
+		if c.err != nil {
+			return
+		}
+		var prev tlog.Tree
+		delay := minDelay
+		for {
+			tree, err := fetchCheckpoint(ctx)
+			if err != nil {
+				c.err = fmt.Errorf("fetching checkpoint: %w", err)
+				return
+			}
+			if prev.N > 0 {
+				if err := c.VerifyConsistency(ctx, prev, tree); err != nil {
+					c.err = err
+					return
 				}
 			}
-			hashes, err := tlog.TileHashReader(tree, c.tr).ReadHashes(indexes)
+			prev = tree
+
+			for i, entry := range c.EntriesSumDB(ctx, tree, start) {
+				if !yield(i, entry) {
+					return
+				}
+			}
+			if c.err != nil {
+				return
+			}
+			if c.pos > start {
+				start = c.pos
+				delay = minDelay
+				continue
+			}
+
+			t := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				c.err = ctx.Err()
+				return
+			case <-t.C:
+			}
+			delay = min(delay*2, maxDelay)
+		}
+	}
+}
+
+// ErrTreeInconsistent is returned by [Client.VerifyConsistency] if the new
+// tree doesn't extend the old one.
+var ErrTreeInconsistent = errors.New("trees are not consistent")
+
+// VerifyConsistency checks that newTree extends oldTree, fetching the hash
+// tiles necessary to prove it. It can be used to chain trust from a previously
+// verified checkpoint to a new one before iterating over its entries.
+//
+// A proof failure is reported as an error wrapping [ErrTreeInconsistent],
+// which might indicate a fork of the log. Unlike the entries iterators,
+// VerifyConsistency doesn't affect [Client.Error].
+func (c *Client) VerifyConsistency(ctx context.Context, oldTree, newTree tlog.Tree) error {
+	switch {
+	case newTree.N < oldTree.N:
+		return fmt.Errorf("%w: new tree size %d is smaller than old tree size %d",
+			ErrTreeInconsistent, newTree.N, oldTree.N)
+	case newTree.N == oldTree.N:
+		if newTree.Hash != oldTree.Hash {
+			return fmt.Errorf("%w: different hashes for tree size %d", ErrTreeInconsistent, newTree.N)
+		}
+		return nil
+	case oldTree.N == 0:
+		return nil
+	}
+	hr := c.hashReaderFor(ctx, newTree)
+	proof, err := tlog.ProveTree(newTree.N, oldTree.N, hr)
+	if err != nil {
+		return fmt.Errorf("fetching consistency proof: %w", err)
+	}
+	if err := tlog.CheckTree(proof, newTree.N, newTree.Hash, oldTree.N, oldTree.Hash); err != nil {
+		return fmt.Errorf("%w: %v", ErrTreeInconsistent, err)
+	}
+	return nil
+}
+
+// ForkEvidence is evidence that a log presented two inconsistent views of its
+// tree, as returned by [Client.DetectFork].
+type ForkEvidence struct {
+	// Old and New are the two signed checkpoints, with Old being the one with
+	// the smaller (or equal) tree size.
+	Old, New []byte
+
+	// OldTree and NewTree are the trees of Old and New.
+	OldTree, NewTree tlog.Tree
+
+	// Proof is the consistency proof from OldTree to NewTree, as served by the
+	// log for NewTree, which fails to verify. It's empty if the two trees
+	// have the same size.
+	Proof tlog.TreeProof
+}
+
+// DetectFork checks whether two signed checkpoints for the same log are
+// consistent, fetching the hash tiles of the larger tree to prove it.
+//
+// If they are not, it returns evidence of the fork, which consists of the two
+// checkpoints, verified with verifier and for the same origin. If they are
+// consistent, it returns nil and no error. Any other failure, including
+// failing to fetch a consistency proof that matches the larger tree, is
+// returned as an error.
+//
+// Like VerifyConsistency, DetectFork doesn't affect [Client.Error].
+func (c *Client) DetectFork(ctx context.Context, a, b []byte, verifier note.Verifier) (*ForkEvidence, error) {
+	open := func(signed []byte) (tlogx.Checkpoint, error) {
+		n, err := note.Open(signed, note.VerifierList(verifier))
+		if err != nil {
+			return tlogx.Checkpoint{}, fmt.Errorf("verifying checkpoint: %w", err)
+		}
+		cp, err := tlogx.ParseCheckpoint(n.Text)
+		if err != nil {
+			return tlogx.Checkpoint{}, fmt.Errorf("parsing checkpoint: %w", err)
+		}
+		return cp, nil
+	}
+	cpA, err := open(a)
+	if err != nil {
+		return nil, err
+	}
+	cpB, err := open(b)
+	if err != nil {
+		return nil, err
+	}
+	if cpA.Origin != cpB.Origin {
+		return nil, fmt.Errorf("checkpoints have different origins %q and %q", cpA.Origin, cpB.Origin)
+	}
+	if cpA.N > cpB.N {
+		a, b, cpA, cpB = b, a, cpB, cpA
+	}
+	e := &ForkEvidence{Old: a, New: b, OldTree: cpA.Tree, NewTree: cpB.Tree}
+
+	switch {
+	case cpA.N == cpB.N:
+		if cpA.Hash != cpB.Hash {
+			return e, nil
+		}
+		return nil, nil
+	case cpA.N == 0:
+		return nil, nil
+	}
+	e.Proof, err = tlog.ProveTree(cpB.N, cpA.N, c.hashReaderFor(ctx, cpB.Tree))
+	if err != nil {
+		return nil, fmt.Errorf("fetching consistency proof: %w", err)
+	}
+	if err := tlog.CheckTree(e.Proof, cpB.N, cpB.Hash, cpA.N, cpA.Hash); err != nil {
+		return e, nil
+	}
+	return nil, nil
+}
+
+// EntriesReverse is like EntriesSumDB, but yields entries in descending index
+// order, from the end of the tree down to start.
+//
+// Like EntriesSumDB, it skips the trailing partial tile, unless start lands
+// inside it or [Client.SetIncludePartial] was called, so the first entry
+// yielded might be before the end of the tree.
+func (c *Client) EntriesReverse(ctx context.Context, tree tlog.Tree, start int64) iter.Seq2[int64, []byte] {
+	return func(yield func(int64, []byte) bool) {
+		if c.err != nil {
+			return
+		}
+		if tree.N < start {
+			c.err = fmt.Errorf("%w: tree size %d, start %d", ErrTreeShrunk, tree.N, start)
+			return
+		}
+		height := c.tr.Height()
+		tileWidth := int64(1) << height
+		base := start / tileWidth * tileWidth
+		top := tree.N / tileWidth * tileWidth
+		if top-base == 0 || c.includePartial {
+			top = tree.N
+		}
+		for top > start {
+			tiles := make([]tlog.Tile, 0, 50)
+			for len(tiles) < 50 && top > base {
+				tileStart := (top - 1) / tileWidth * tileWidth
+				tiles = append(tiles, tlog.Tile{H: height, L: -1,
+					N: tileStart / tileWidth, W: int(top - tileStart)})
+				top = tileStart
+			}
+
+			entries, err := c.readEntryTiles(ctx, tree, tiles)
 			if err != nil {
 				c.err = err
 				return
@@ -92,48 +593,293 @@ func (c *Client) EntriesSumDB(tree tlog.Tree, start int64) iter.Seq2[int64, []by
 
 			for ti, t := range tiles {
 				tileStart := t.N * tileWidth
-				tileEnd := tileStart + int64(t.W)
-				data := tdata[ti]
-				for i := tileStart; i < tileEnd; i++ {
-					if len(data) == 0 {
-						c.err = fmt.Errorf("unexpected end of tile data")
-						return
-					}
-
-					var entry []byte
-					if idx := bytes.Index(data, []byte("\n\n")); idx >= 0 {
-						// Add back one of the newlines.
-						entry, data = data[:idx+1], data[idx+2:]
-					} else {
-						entry, data = data, nil
-					}
-
-					if tlog.RecordHash(entry) != hashes[i-base] {
-						c.err = fmt.Errorf("hash mismatch for entry %d", i)
+				for j := len(entries[ti]) - 1; j >= 0; j-- {
+					i := tileStart + int64(j)
+					if i < start {
 						return
 					}
-
-					if i < start {
-						continue
+					if entries[ti][j] == nil {
+						continue // skipped in audit mode
 					}
-					if !yield(i, entry) {
+					if !yield(i, entries[ti][j]) {
 						return
 					}
 				}
-				if len(data) != 0 {
-					c.err = fmt.Errorf("unexpected leftover data in tile")
-					return
+			}
+		}
+	}
+}
+
+// NewEntryReader returns a reader for the entry at index in tree, read from
+// the data tile that contains it.
+//
+// The entry is not verified in advance: its record hash is computed as it's
+// read, and checked against tree once the entry is exhausted. If it doesn't
+// match, the final Read returns a [VerificationError] instead of [io.EOF], so
+// callers streaming the entry must not trust it until then. Errors fetching
+// the tiles are also returned by Read.
+//
+// The data tile is still fetched as a whole, but the entry is not copied nor
+// buffered again.
+func NewEntryReader(ctx context.Context, tr tlog.TileReader, tree tlog.Tree, index int64) io.Reader {
+	return &entryReader{ctx: ctx, tr: tr, tree: tree, index: index}
+}
+
+type entryReader struct {
+	ctx   context.Context
+	tr    tlog.TileReader
+	tree  tlog.Tree
+	index int64
+
+	tile    tlog.Tile
+	started bool
+	data    []byte // unread part of the entry
+	h       hash.Hash
+	err     error
+}
+
+func (r *entryReader) Read(p []byte) (n int, err error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if !r.started {
+		r.started = true
+		if r.err = r.readEntry(); r.err != nil {
+			return 0, r.err
+		}
+	}
+	if len(r.data) == 0 {
+		r.err = r.verify()
+		return 0, r.err
+	}
+	n = copy(p, r.data)
+	r.h.Write(p[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// readEntry fetches the data tile, and locates the entry in it.
+func (r *entryReader) readEntry() error {
+	if r.index < 0 || r.index >= r.tree.N {
+		return fmt.Errorf("index %d out of range for tree size %d", r.index, r.tree.N)
+	}
+	height := r.tr.Height()
+	tileStart := r.index >> height << height
+	r.tile = tlog.Tile{H: height, L: -1, N: r.index >> height,
+		W: int(min(r.tree.N-tileStart, 1<<height))}
+	tdata, err := readTiles(r.ctx, r.tr, []tlog.Tile{r.tile})
+	if err != nil {
+		return err
+	}
+	data := tdata[0]
+	for i := tileStart; ; i++ {
+		if len(data) == 0 {
+			return ErrUnexpectedEndOfTile
+		}
+		var entry []byte
+		if idx := bytes.Index(data, []byte("\n\n")); idx >= 0 {
+			// Add back one of the newlines.
+			entry, data = data[:idx+1], data[idx+2:]
+		} else {
+			entry, data = data, nil
+		}
+		if i == r.index {
+			r.data = entry
+			break
+		}
+	}
+	r.h = sha256.New()
+	r.h.Write([]byte{0x00}) // tlog.RecordHash prefix
+	return nil
+}
+
+// verify checks the record hash of the entry against the tree, and returns
+// io.EOF if it matches.
+func (r *entryReader) verify() error {
+	var got tlog.Hash
+	r.h.Sum(got[:0])
+	hr := TileHashReaderWithContext(r.ctx, r.tree, r.tr)
+	want, err := hr.ReadHashes([]int64{tlog.StoredHashIndex(0, r.index)})
+	if err != nil {
+		return err
+	}
+	if got != want[0] {
+		return &VerificationError{Tile: r.tile, Index: r.index}
+	}
+	return io.EOF
+}
+
+// hashReaderFor returns the HashReader set with [Client.SetHashReader], or one
+// that reads hash tiles verified against tree.
+func (c *Client) hashReaderFor(ctx context.Context, tree tlog.Tree) tlog.HashReader {
+	if c.hashReader != nil {
+		return c.hashReader(ctx, tree)
+	}
+	return TileHashReaderWithContext(ctx, tree, c.tr)
+}
+
+// readEntryTiles fetches the data tiles, verifies each of their entries
+// against tree, saves the tiles, and returns the entries of each tile.
+func (c *Client) readEntryTiles(ctx context.Context, tree tlog.Tree, tiles []tlog.Tile) ([][][]byte, error) {
+	if c.batchTimeout <= 0 {
+		return c.readEntryTilesWithContext(ctx, tree, tiles)
+	}
+	batchCtx, cancel := context.WithTimeoutCause(ctx, c.batchTimeout, ErrBatchTimeout)
+	defer cancel()
+	entries, err := c.readEntryTilesWithContext(batchCtx, tree, tiles)
+	if err != nil && ctx.Err() == nil && context.Cause(batchCtx) == ErrBatchTimeout {
+		return nil, fmt.Errorf("%w (%v): %w", ErrBatchTimeout, c.batchTimeout, err)
+	}
+	return entries, err
+}
+
+func (c *Client) readEntryTilesWithContext(ctx context.Context, tree tlog.Tree, tiles []tlog.Tile) ([][][]byte, error) {
+	tdata, err := readTiles(ctx, c.tr, tiles)
+	if err != nil {
+		return nil, err
+	}
+
+	// For full tiles, read only the level H hash, which is checked against
+	// the hash of the whole tile. This avoids fetching the level 0 hash
+	// tiles, which are as many as the data tiles. For partial tiles, and for
+	// full tiles that fail the check, read the level 0 hash of each entry.
+	hr := c.hashReaderFor(ctx, tree)
+	indexes := make([]int64, 0, len(tiles))
+	for _, t := range tiles {
+		if t.W == 1<<t.H {
+			indexes = append(indexes, tlog.StoredHashIndex(t.H, t.N))
+		} else {
+			indexes = append(indexes, leafHashIndexes(t)...)
+		}
+	}
+	hashes, err := hr.ReadHashes(indexes)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([][][]byte, len(tiles))
+	saveTiles, saveData := make([]tlog.Tile, 0, len(tiles)), make([][]byte, 0, len(tiles))
+	for ti, t := range tiles {
+		tileStart := t.N << t.H
+		tileEnd := tileStart + int64(t.W)
+		data := tdata[ti]
+		entries[ti] = make([][]byte, 0, t.W)
+		recordHashes := make([]tlog.Hash, 0, t.W)
+		// In audit mode, a tile can have tolerated failures, in which case
+		// it's not saved.
+		verified := true
+		for range t.W {
+			if len(data) == 0 {
+				if !c.tolerate(tileStart+int64(len(entries[ti])), ErrUnexpectedEndOfTile) {
+					return nil, ErrUnexpectedEndOfTile
 				}
-				start = tileEnd
+				verified = false
+				break
 			}
 
-			c.tr.SaveTiles(tiles, tdata)
+			var entry []byte
+			if idx := bytes.Index(data, []byte("\n\n")); idx >= 0 {
+				// Add back one of the newlines.
+				entry, data = data[:idx+1], data[idx+2:]
+			} else {
+				entry, data = data, nil
+			}
+			entries[ti] = append(entries[ti], entry)
+			recordHashes = append(recordHashes, tlog.RecordHash(entry))
+		}
 
-			if start == top {
-				return
+		var want []tlog.Hash
+		var tileMismatch bool
+		if t.W == 1<<t.H {
+			tileHash := hashes[0]
+			hashes = hashes[1:]
+			if len(recordHashes) != t.W || subtreeHash(recordHashes) != tileHash {
+				// A full tile must hash to its level H node. If it doesn't,
+				// the data tile is inconsistent with the hash tiles as a
+				// whole, which is stronger evidence of a fork than a single
+				// mismatched entry. Read the level 0 hashes to find out
+				// which entries are affected.
+				tileMismatch = len(recordHashes) == t.W
+				want, err = hr.ReadHashes(leafHashIndexes(t))
+				if err != nil {
+					return nil, err
+				}
 			}
+		} else {
+			want = hashes[:t.W]
+			hashes = hashes[t.W:]
 		}
+		for j, rh := range recordHashes {
+			if want == nil {
+				break // verified as a whole against the level H hash
+			}
+			if rh != want[j] {
+				if c.hook != nil {
+					c.hook(t, tileStart+int64(j), rh, want[j], entries[ti][j])
+				}
+				err := &VerificationError{Tile: t, Index: tileStart + int64(j)}
+				if tileMismatch {
+					err.Err = ErrTileMismatch
+				}
+				if !c.tolerate(err.Index, err) {
+					return nil, err
+				}
+				verified = false
+				// Skipped by the iterators.
+				entries[ti][j] = nil
+			}
+		}
+		if tileMismatch && verified {
+			// Unreachable, since the level 0 hashes were verified against the
+			// level H hash by TileHashReader, but don't rely on it, also
+			// because a custom HashReader might not do the same.
+			err := &VerificationError{Tile: t, Index: tileStart, Err: ErrTileMismatch}
+			if !c.tolerate(tileStart, err) {
+				return nil, err
+			}
+			verified = false
+		}
+		if len(data) != 0 {
+			if c.hook != nil {
+				c.hook(t, tileEnd, tlog.Hash{}, tlog.Hash{}, data)
+			}
+			if !c.tolerate(tileEnd, ErrLeftoverData) {
+				return nil, ErrLeftoverData
+			}
+			verified = false
+		}
+		for len(entries[ti]) < t.W {
+			entries[ti] = append(entries[ti], nil)
+		}
+		if verified {
+			saveTiles = append(saveTiles, t)
+			saveData = append(saveData, tdata[ti])
+		}
+	}
+
+	c.tr.SaveTiles(saveTiles, saveData)
+
+	return entries, nil
+}
+
+// leafHashIndexes returns the stored hash indexes of the level 0 hashes of the
+// entries in the data tile t.
+func leafHashIndexes(t tlog.Tile) []int64 {
+	indexes := make([]int64, 0, t.W)
+	for i := range t.W {
+		indexes = append(indexes, tlog.StoredHashIndex(0, t.N<<t.H+int64(i)))
+	}
+	return indexes
+}
+
+// tolerate reports whether the verification failure err at index should be
+// recorded and skipped, according to the function set with SetAuditMode.
+func (c *Client) tolerate(index int64, err error) bool {
+	if c.audit == nil || !c.audit(index, err) {
+		return false
 	}
+	c.auditErrs = append(c.auditErrs, err)
+	return true
 }
 
 type tileWithData struct {
@@ -142,8 +888,12 @@ type tileWithData struct {
 }
 
 type edgeMemoryCache struct {
-	tr tlog.TileReader
-	t  map[int][2]tileWithData
+	tr    tlog.TileReader
+	t     map[int][2]tileWithData
+	stats ClientStats
+
+	// saved, if not nil, is called with the tiles passed to the lower layer.
+	saved func(tiles []tlog.Tile, data [][]byte)
 }
 
 func (c *edgeMemoryCache) Height() int {
@@ -151,6 +901,10 @@ func (c *edgeMemoryCache) Height() int {
 }
 
 func (c *edgeMemoryCache) ReadTiles(tiles []tlog.Tile) (data [][]byte, err error) {
+	return c.ReadTilesContext(context.Background(), tiles)
+}
+
+func (c *edgeMemoryCache) ReadTilesContext(ctx context.Context, tiles []tlog.Tile) (data [][]byte, err error) {
 	data = make([][]byte, len(tiles))
 	missing := make([]tlog.Tile, 0, len(tiles))
 	for i, t := range tiles {
@@ -162,19 +916,38 @@ func (c *edgeMemoryCache) ReadTiles(tiles []tlog.Tile) (data [][]byte, err error
 			missing = append(missing, t)
 		}
 	}
-	if len(missing) == 0 {
-		return data, nil
-	}
-	missingData, err := c.tr.ReadTiles(missing)
-	if err != nil {
-		return nil, err
-	}
-	for i := range data {
-		if data[i] == nil {
-			data[i] = missingData[0]
-			missingData = missingData[1:]
+	c.stats.MemoryHits += int64(len(tiles) - len(missing))
+	if len(missing) > 0 {
+		var missingData [][]byte
+		var hits []bool
+		if pc, ok := c.tr.(*PermanentCache); ok {
+			missingData, hits, err = pc.readTilesWithHits(ctx, missing)
+		} else {
+			missingData, err = readTiles(ctx, c.tr, missing)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i, d := range missingData {
+			if hits != nil && hits[i] {
+				c.stats.CacheHits++
+				c.stats.CacheBytes += int64(len(d))
+			} else {
+				c.stats.Fetched++
+				c.stats.FetchedBytes += int64(len(d))
+			}
+		}
+		for i := range data {
+			if data[i] == nil {
+				data[i] = missingData[0]
+				missingData = missingData[1:]
+			}
 		}
 	}
+	c.stats.Tiles += int64(len(tiles))
+	for _, d := range data {
+		c.stats.Bytes += int64(len(d))
+	}
 	return data, nil
 }
 
@@ -190,7 +963,12 @@ func (c *edgeMemoryCache) SaveTiles(tiles []tlog.Tile, data [][]byte) {
 		ds = append(ds, data[i])
 	}
 	c.tr.SaveTiles(ts, ds)
+	if c.saved != nil && len(ts) > 0 {
+		c.saved(ts, ds)
+	}
 
+	// Always keep the rightmost tile, and replace the other one, so that the
+	// moving edge can go in either direction.
 	for i, t := range tiles {
 		td, ok := c.t[t.L]
 		switch {
@@ -198,9 +976,9 @@ func (c *edgeMemoryCache) SaveTiles(tiles []tlog.Tile, data [][]byte) {
 			c.t[t.L] = [2]tileWithData{{Tile: t, data: data[i]}}
 		case td[0].Tile == t || td[1].Tile == t:
 			// Already saved.
-		case tileLess(td[0].Tile, t) && tileLess(td[0].Tile, td[1].Tile):
+		case tileLess(td[0].Tile, td[1].Tile):
 			c.t[t.L] = [2]tileWithData{{Tile: t, data: data[i]}, td[1]}
-		case tileLess(td[1].Tile, t) && tileLess(td[1].Tile, td[0].Tile):
+		default:
 			c.t[t.L] = [2]tileWithData{td[0], {Tile: t, data: data[i]}}
 		}
 	}
@@ -225,6 +1003,34 @@ type TileFetcher struct {
 	hc    *http.Client
 	log   *slog.Logger
 	limit int
+
+	// transport is the Transport of the default hc, or nil if SetHTTPClient
+	// was called.
+	transport *http.Transport
+
+	fullTileFallback bool
+
+	// etags holds the ETag and contents of the last partial tile fetched at
+	// each tile coordinate, if SetConditionalRequests was enabled.
+	conditional bool
+	etagsMu     sync.Mutex
+	etags       map[tileCoord]partialTile
+
+	// breaker is nil unless SetCircuitBreaker was called.
+	breaker *circuitBreaker
+
+	height int
+}
+
+type tileCoord struct {
+	L int
+	N int64
+}
+
+type partialTile struct {
+	w    int
+	etag string
+	data []byte
 }
 
 func NewSumDBFetcher(base string) *TileFetcher {
@@ -236,50 +1042,365 @@ func NewSumDBFetcher(base string) *TileFetcher {
 	return &TileFetcher{base: base, hc: &http.Client{
 		Transport: transport,
 		Timeout:   10 * time.Second,
-	}, log: slog.New(slogDiscardHandler{})}
+	}, log: slog.New(slogDiscardHandler{}), transport: transport, height: tileHeight}
 }
 
 func (f *TileFetcher) SetLogger(log *slog.Logger) {
 	f.log = log
 }
 
+// SetHTTPClient sets the HTTP client used to fetch tiles, replacing the
+// default one and any transport tuning applied to it, such as by
+// SetMaxIdleConnsPerHost.
 func (f *TileFetcher) SetHTTPClient(hc *http.Client) {
 	f.hc = hc
+	f.transport = nil
+}
+
+// SetMaxIdleConnsPerHost sets the MaxIdleConnsPerHost of the default HTTP
+// client's Transport. By default, it's the same as MaxIdleConns, to keep
+// connections warm for parallel fetches from a single log. If zero,
+// [http.DefaultMaxIdleConnsPerHost] is used.
+//
+// It has no effect if SetHTTPClient was called.
+func (f *TileFetcher) SetMaxIdleConnsPerHost(n int) {
+	if f.transport != nil {
+		f.transport.MaxIdleConnsPerHost = n
+	}
 }
 
 func (f *TileFetcher) SetLimit(limit int) {
 	f.limit = limit
 }
 
+// SetFullTileFallback sets whether a partial tile that is not found is fetched
+// instead as the corresponding full tile, truncated to the requested width.
+//
+// Logs are allowed to delete partial tiles once the full tile is available, so
+// this lets clients request partial tiles based on an older tree size. It's
+// disabled by default.
+func (f *TileFetcher) SetFullTileFallback(enabled bool) {
+	f.fullTileFallback = enabled
+}
+
+// SetConditionalRequests sets whether the ETag of the last partial tile fetched
+// at each tile coordinate is remembered, and sent in an If-None-Match header
+// when the same partial tile is requested again. A 304 Not Modified response
+// is then served from memory.
+//
+// This reduces bandwidth for clients polling the tail of a log. Full tiles are
+// immutable and are not affected, use [PermanentCache] to cache them. It's
+// disabled by default.
+func (f *TileFetcher) SetConditionalRequests(enabled bool) {
+	f.etagsMu.Lock()
+	defer f.etagsMu.Unlock()
+	f.conditional = enabled
+	f.etags = nil
+	if enabled {
+		f.etags = make(map[tileCoord]partialTile)
+	}
+}
+
+// SetCircuitBreaker makes the fetcher stop making requests for cooldown after
+// failures consecutive failed requests, each within window of the first one.
+// While the breaker is open, requests fail immediately with an error wrapping
+// [ErrCircuitOpen]. After cooldown, a single request is allowed through as a
+// probe: if it succeeds, requests resume, otherwise the breaker opens again.
+//
+// Network errors and unexpected responses count as failures, except for 404 Not
+// Found. It's disabled by default, or if failures is zero.
+func (f *TileFetcher) SetCircuitBreaker(failures int, window, cooldown time.Duration) {
+	f.breaker = nil
+	if failures > 0 {
+		f.breaker = &circuitBreaker{threshold: failures, window: window, cooldown: cooldown}
+	}
+}
+
+// ErrCircuitOpen is wrapped by the [FetchError] returned by [TileFetcher] if
+// the circuit breaker set with [TileFetcher.SetCircuitBreaker] is open.
+var ErrCircuitOpen = errors.New("too many recent failures, not fetching tiles")
+
+type circuitBreaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	first     time.Time // time of the first of the consecutive failures
+	openUntil time.Time // zero if the breaker is closed
+	probing   bool
+}
+
+// allow reports whether a request can be made, and whether it's the probe
+// allowed after the cooldown, which must be passed to record.
+func (b *circuitBreaker) allow() (ok, probe bool) {
+	if b == nil {
+		return true, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.openUntil.IsZero():
+		return true, false
+	case time.Now().Before(b.openUntil) || b.probing:
+		return false, false
+	default:
+		b.probing = true
+		return true, true
+	}
+}
+
+// record updates the breaker state with the outcome of an allowed request,
+// and reports whether it caused the breaker to open.
+func (b *circuitBreaker) record(ctx context.Context, probe bool, err error) (opened bool) {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	} else if !b.openUntil.IsZero() {
+		// The request started before the breaker opened, and only the probe
+		// decides whether it closes again.
+		return false
+	}
+	now := time.Now()
+	switch {
+	case ctx.Err() != nil:
+		// The request was canceled, which says nothing about the server.
+		// If it was a probe, the next request will probe again.
+		return false
+	case err == nil || errors.Is(err, errTileNotFound):
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return false
+	case probe:
+		b.openUntil = now.Add(b.cooldown)
+		return true
+	}
+	if b.failures == 0 || now.Sub(b.first) > b.window {
+		b.failures, b.first = 0, now
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.failures = 0
+		b.openUntil = now.Add(b.cooldown)
+		return true
+	}
+	return false
+}
+
+// SetTileHeight sets the tile height of the log, which is returned by
+// [TileFetcher.Height] and used by [Client] to request tiles. The default is 8,
+// which is used by the Go Checksum Database and by logs following the
+// c2sp.org/tlog-tiles specification. It must not be changed while the fetcher
+// is in use.
+func (f *TileFetcher) SetTileHeight(height int) {
+	f.height = height
+}
+
 func (f *TileFetcher) Height() int {
-	return tileHeight
+	return f.height
 }
 
 func (f *TileFetcher) ReadTiles(tiles []tlog.Tile) (data [][]byte, err error) {
+	return f.ReadTilesContext(context.Background(), tiles)
+}
+
+func (f *TileFetcher) ReadTilesContext(ctx context.Context, tiles []tlog.Tile) (data [][]byte, err error) {
+	// Fetch each distinct tile only once.
+	unique := make([]tlog.Tile, 0, len(tiles))
+	seen := make(map[tlog.Tile]int, len(tiles))
+	for _, t := range tiles {
+		if _, ok := seen[t]; !ok {
+			seen[t] = len(unique)
+			unique = append(unique, t)
+		}
+	}
+	uniqueData, err := f.readUniqueTiles(ctx, unique)
+	if err != nil {
+		return nil, err
+	}
+	if len(unique) == len(tiles) {
+		return uniqueData, nil
+	}
+	data = make([][]byte, len(tiles))
+	for i, t := range tiles {
+		data[i] = uniqueData[seen[t]]
+	}
+	return data, nil
+}
+
+func (f *TileFetcher) readUniqueTiles(ctx context.Context, tiles []tlog.Tile) (data [][]byte, err error) {
 	data = make([][]byte, len(tiles))
-	errGroup, ctx := errgroup.WithContext(context.Background())
+	errGroup, ctx := errgroup.WithContext(ctx)
 	if f.limit > 0 {
 		errGroup.SetLimit(f.limit)
 	}
 	for i, t := range tiles {
 		errGroup.Go(func() error {
-			resp, err := f.hc.Get(f.base + t.Path())
-			if err != nil {
-				return fmt.Errorf("%s: %w", t.Path(), err)
-			}
-			defer resp.Body.Close()
-			if resp.StatusCode != http.StatusOK {
-				return fmt.Errorf("%s: unexpected status code %d", t.Path(), resp.StatusCode)
+			d, err := f.fetch(ctx, t)
+			if errors.Is(err, errTileNotFound) && f.fullTileFallback && t.W < 1<<t.H {
+				full := t
+				full.W = 1 << t.H
+				f.log.InfoContext(ctx, "partial tile not found, fetching full tile",
+					"path", t.Path(), "full", full.Path())
+				d, err = f.fetch(ctx, full)
+				if err != nil {
+					return err
+				}
+				d, err = truncateTile(t, d)
+				if err != nil {
+					return fmt.Errorf("%s: %w", full.Path(), err)
+				}
 			}
-			data[i], err = io.ReadAll(resp.Body)
 			if err != nil {
-				return fmt.Errorf("%s: %w", t.Path(), err)
+				return err
 			}
-			f.log.InfoContext(ctx, "fetched tile", "path", t.Path(), "size", len(data[i]))
+			data[i] = d
 			return nil
 		})
 	}
-	return data, errGroup.Wait()
+	if err := errGroup.Wait(); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// A FetchError is returned by [TileFetcher] if a tile can't be fetched.
+type FetchError struct {
+	Tile tlog.Tile
+	// StatusCode is the HTTP response status code, or zero if no response
+	// was received.
+	StatusCode int
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (e *FetchError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Tile.Path(), e.Err)
+	}
+	return fmt.Sprintf("%s: unexpected status code %d", e.Tile.Path(), e.StatusCode)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+var errTileNotFound = errors.New("tile not found")
+
+// ErrNonTileContent is wrapped by the [FetchError] returned by [TileFetcher]
+// if the tile server responds with something that can't be a tile, such as an
+// HTML error page from a proxy or captive portal, or a hash tile of the wrong
+// size. This usually indicates an infrastructure problem rather than a log
+// misbehaving.
+var ErrNonTileContent = errors.New("tile server returned non-tile content")
+
+func (f *TileFetcher) fetch(ctx context.Context, t tlog.Tile) ([]byte, error) {
+	ok, probe := f.breaker.allow()
+	if !ok {
+		return nil, &FetchError{Tile: t, Err: ErrCircuitOpen}
+	}
+	data, err := f.fetchTile(ctx, t)
+	if f.breaker.record(ctx, probe, err) {
+		f.log.WarnContext(ctx, "too many failed tile fetches, pausing requests",
+			"cooldown", f.breaker.cooldown, "err", err)
+	}
+	return data, err
+}
+
+func (f *TileFetcher) fetchTile(ctx context.Context, t tlog.Tile) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", f.base+t.Path(), nil)
+	if err != nil {
+		return nil, &FetchError{Tile: t, Err: err}
+	}
+	f.etagsMu.Lock()
+	conditional := f.conditional
+	cached, haveCached := f.etags[tileCoord{t.L, t.N}]
+	f.etagsMu.Unlock()
+	haveCached = haveCached && cached.w == t.W
+	if conditional && haveCached {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+	resp, err := f.hc.Do(req)
+	if err != nil {
+		return nil, &FetchError{Tile: t, Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && conditional && haveCached {
+		f.log.InfoContext(ctx, "partial tile not modified", "path", t.Path(), "size", len(cached.data))
+		return cached.data, nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &FetchError{Tile: t, StatusCode: resp.StatusCode, Err: errTileNotFound}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &FetchError{Tile: t, StatusCode: resp.StatusCode}
+	}
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt == "text/html" {
+		return nil, &FetchError{Tile: t, StatusCode: resp.StatusCode,
+			Err: fmt.Errorf("%w: Content-Type is %s", ErrNonTileContent, mt)}
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &FetchError{Tile: t, StatusCode: resp.StatusCode, Err: err}
+	}
+	if t.L >= 0 && len(data) != t.W*tlog.HashSize {
+		return nil, &FetchError{Tile: t, StatusCode: resp.StatusCode,
+			Err: fmt.Errorf("%w: hash tile is %d bytes, expected %d", ErrNonTileContent, len(data), t.W*tlog.HashSize)}
+	}
+	f.log.InfoContext(ctx, "fetched tile", "path", t.Path(), "size", len(data))
+	if conditional {
+		f.etagsMu.Lock()
+		if etag := resp.Header.Get("ETag"); etag != "" && t.W < 1<<t.H && f.etags != nil {
+			f.etags[tileCoord{t.L, t.N}] = partialTile{w: t.W, etag: etag, data: data}
+		} else {
+			// Once the full tile is available, the partial ones won't be
+			// requested again.
+			delete(f.etags, tileCoord{t.L, t.N})
+		}
+		f.etagsMu.Unlock()
+	}
+	return data, nil
+}
+
+// truncateTile returns the prefix of the full tile data that makes up the
+// partial tile t. Hash tiles are made of t.W hashes, while data tiles are made
+// of t.W entries in the sumdb format, each ending in a newline and separated by
+// an empty line.
+func truncateTile(t tlog.Tile, data []byte) ([]byte, error) {
+	if t.L >= 0 {
+		if len(data) < t.W*tlog.HashSize {
+			return nil, errors.New("full hash tile is too short")
+		}
+		return data[:t.W*tlog.HashSize], nil
+	}
+	var n int
+	for range t.W {
+		idx := bytes.Index(data[n:], []byte("\n\n"))
+		if idx < 0 {
+			return nil, errors.New("full data tile has too few entries")
+		}
+		n += idx + 2
+	}
+	// Drop the separator after the last entry.
+	return data[:n-1], nil
+}
+
+// subtreeHash returns the root hash of a perfect subtree with the given leaf
+// hashes. len(hashes) must be a power of two.
+func subtreeHash(hashes []tlog.Hash) tlog.Hash {
+	hashes = slices.Clone(hashes)
+	for len(hashes) > 1 {
+		for i := range len(hashes) / 2 {
+			hashes[i] = tlog.NodeHash(hashes[2*i], hashes[2*i+1])
+		}
+		hashes = hashes[:len(hashes)/2]
+	}
+	return hashes[0]
 }
 
 func (f *TileFetcher) SaveTiles(tiles []tlog.Tile, data [][]byte) {}
@@ -295,68 +1416,427 @@ type PermanentCache struct {
 	tr  tlog.TileReader
 	dir string
 	log *slog.Logger
+
+	// inflight tracks the tiles that are being fetched from tr, so that
+	// concurrent misses for the same tile share a single fetch.
+	mu       sync.Mutex
+	inflight map[tlog.Tile]*tileFetch
+
+	hits, misses, saved    atomic.Int64
+	hitBytes, fetchedBytes atomic.Int64
+
+	compress bool
+}
+
+// CacheStats are the counters of a [PermanentCache].
+type CacheStats struct {
+	// Hits and Misses are the number of tiles that were and weren't found on
+	// disk, respectively.
+	Hits, Misses int64
+	// HitBytes is the number of bytes loaded from disk.
+	HitBytes int64
+	// FetchedBytes is the number of bytes fetched from the underlying
+	// TileReader. It can be less than the size of the missed tiles if
+	// concurrent misses for the same tile were coalesced.
+	FetchedBytes int64
+	// Saved is the number of tiles written to disk.
+	Saved int64
+}
+
+// tileFetch is a pending fetch from the lower layer of a PermanentCache.
+type tileFetch struct {
+	done chan struct{}
+	data []byte
+	err  error
 }
 
 func NewPermanentCache(tr tlog.TileReader, dir string) *PermanentCache {
-	return &PermanentCache{tr: tr, dir: dir, log: slog.New(slogDiscardHandler{})}
+	return &PermanentCache{tr: tr, dir: dir, log: slog.New(slogDiscardHandler{}),
+		inflight: make(map[tlog.Tile]*tileFetch)}
 }
 
 func (c *PermanentCache) SetLogger(log *slog.Logger) {
 	c.log = log
 }
 
+// SetCompression sets whether tiles are gzip-compressed when written to disk,
+// with a .gz suffix. Tiles are always returned decompressed.
+//
+// Both compressed and uncompressed tiles are read regardless of this setting,
+// so it can be enabled or disabled on an existing cache.
+func (c *PermanentCache) SetCompression(enabled bool) {
+	c.compress = enabled
+}
+
+// Stats returns the current values of the cache counters.
+//
+// It's safe to call Stats concurrently with other methods.
+func (c *PermanentCache) Stats() CacheStats {
+	return CacheStats{
+		Hits:         c.hits.Load(),
+		Misses:       c.misses.Load(),
+		HitBytes:     c.hitBytes.Load(),
+		FetchedBytes: c.fetchedBytes.Load(),
+		Saved:        c.saved.Load(),
+	}
+}
+
 func (c *PermanentCache) Height() int {
 	return c.tr.Height()
 }
 
 func (c *PermanentCache) ReadTiles(tiles []tlog.Tile) (data [][]byte, err error) {
+	return c.ReadTilesContext(context.Background(), tiles)
+}
+
+func (c *PermanentCache) ReadTilesContext(ctx context.Context, tiles []tlog.Tile) (data [][]byte, err error) {
+	data, _, err = c.readTilesWithHits(ctx, tiles)
+	return data, err
+}
+
+// readTilesWithHits is like ReadTilesContext, but also reports which tiles
+// were loaded from disk.
+func (c *PermanentCache) readTilesWithHits(ctx context.Context, tiles []tlog.Tile) (data [][]byte, hits []bool, err error) {
 	data = make([][]byte, len(tiles))
-	missing := make([]tlog.Tile, 0, len(tiles))
+	hits = make([]bool, len(tiles))
+	missing := make([]int, 0, len(tiles))
 	for i, t := range tiles {
-		path := filepath.Join(c.dir, t.Path())
-		if d, err := os.ReadFile(path); errors.Is(err, os.ErrNotExist) {
-			missing = append(missing, t)
+		if d, err := c.readFile(t); errors.Is(err, os.ErrNotExist) {
+			missing = append(missing, i)
 		} else if err != nil {
-			return nil, err
+			return nil, nil, err
 		} else {
 			c.log.Info("loaded tile from cache", "path", t.Path(), "size", len(d))
+			c.hits.Add(1)
+			c.hitBytes.Add(int64(len(d)))
 			data[i] = d
+			hits[i] = true
 		}
 	}
+	c.misses.Add(int64(len(missing)))
 	if len(missing) == 0 {
-		return data, nil
+		return data, hits, nil
 	}
-	missingData, err := c.tr.ReadTiles(missing)
-	if err != nil {
+
+	// Join any fetch already in progress for the missing tiles, and fetch the
+	// rest in a single batch from the lower layer. If a fetch we joined fails
+	// because the context of the caller that started it was canceled, fetch
+	// those tiles again ourselves, since our context might still be alive.
+	for len(missing) > 0 {
+		waits := make(map[int]*tileFetch, len(missing))
+		fetchTiles := make([]tlog.Tile, 0, len(missing))
+		fetches := make([]*tileFetch, 0, len(missing))
+		c.mu.Lock()
+		for _, i := range missing {
+			f, ok := c.inflight[tiles[i]]
+			if !ok {
+				f = &tileFetch{done: make(chan struct{})}
+				c.inflight[tiles[i]] = f
+				fetchTiles = append(fetchTiles, tiles[i])
+				fetches = append(fetches, f)
+			}
+			waits[i] = f
+		}
+		c.mu.Unlock()
+
+		if len(fetchTiles) > 0 {
+			fetchedData, err := readTiles(ctx, c.tr, fetchTiles)
+			c.mu.Lock()
+			for i, f := range fetches {
+				if err != nil {
+					f.err = err
+				} else {
+					f.data = fetchedData[i]
+					c.fetchedBytes.Add(int64(len(f.data)))
+				}
+				delete(c.inflight, fetchTiles[i])
+				close(f.done)
+			}
+			c.mu.Unlock()
+		}
+
+		missing = missing[:0]
+		for i, f := range waits {
+			select {
+			case <-f.done:
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+			if f.err != nil && !slices.Contains(fetches, f) && ctx.Err() == nil &&
+				(errors.Is(f.err, context.Canceled) || errors.Is(f.err, context.DeadlineExceeded)) {
+				missing = append(missing, i)
+				continue
+			}
+			if f.err != nil {
+				return nil, nil, f.err
+			}
+			data[i] = f.data
+		}
+	}
+	return data, hits, nil
+}
+
+// readFile reads the tile from disk, preferring the compressed version.
+func (c *PermanentCache) readFile(t tlog.Tile) ([]byte, error) {
+	path := filepath.Join(c.dir, t.Path())
+	f, err := os.Open(path + ".gz")
+	if errors.Is(err, os.ErrNotExist) {
+		return os.ReadFile(path)
+	} else if err != nil {
 		return nil, err
 	}
-	for i := range data {
-		if data[i] == nil {
-			data[i] = missingData[0]
-			missingData = missingData[1:]
-		}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s.gz: %w", path, err)
 	}
-	return data, nil
+	d, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s.gz: %w", path, err)
+	}
+	return d, nil
 }
 
 func (c *PermanentCache) SaveTiles(tiles []tlog.Tile, data [][]byte) {
 	for i, t := range tiles {
-		if t.W != tileWidth {
+		if t.W != 1<<t.H {
 			continue // skip partial tiles
 		}
 		path := filepath.Join(c.dir, t.Path())
 		if _, err := os.Stat(path); err == nil {
 			continue
 		}
+		if _, err := os.Stat(path + ".gz"); err == nil {
+			continue
+		}
 		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
 			c.log.Error("failed to create directory", "path", path, "error", err)
 			return
 		}
-		if err := os.WriteFile(path, data[i], 0600); err != nil {
+		d := data[i]
+		if c.compress {
+			buf := &bytes.Buffer{}
+			w := gzip.NewWriter(buf)
+			w.Write(d)
+			w.Close()
+			path, d = path+".gz", buf.Bytes()
+		}
+		if err := os.WriteFile(path, d, 0600); err != nil {
 			c.log.Error("failed to write file", "path", path, "error", err)
 		} else {
 			c.log.Info("saved tile to cache", "path", t.Path(), "size", len(data[i]))
+			c.saved.Add(1)
 		}
 	}
 	c.tr.SaveTiles(tiles, data)
 }
+
+// Verify checks the tiles stored in the cache directory against tree, and
+// returns the ones that don't match it, for example because they were
+// truncated or belong to a different log.
+//
+// Each tile is checked by recomputing the tree hash from it and from the other
+// tiles in the cache, which are only used once they were checked themselves,
+// so that a corrupt tile doesn't cause the ones next to it to be returned.
+// Tiles that are needed for that but are not in the cache (or don't match),
+// such as the partial tiles at the right edge of tree, are read once from the
+// underlying TileReader. Data tiles are expected to be in the format of the Go
+// Checksum Database.
+//
+// Tiles that extend past the end of tree can't be checked, and are ignored.
+// Tiles of a different height than the cache are returned as not matching.
+func (c *PermanentCache) Verify(ctx context.Context, tree tlog.Tree) ([]tlog.Tile, error) {
+	var tiles []tlog.Tile
+	if err := filepath.WalkDir(c.dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(c.dir, path)
+		if err != nil {
+			return err
+		}
+		t, err := tlog.ParseTilePath(strings.TrimSuffix(filepath.ToSlash(rel), ".gz"))
+		if err != nil {
+			return nil // not a tile
+		}
+		tiles = append(tiles, t)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	tiles = slices.Compact(tiles) // foo and foo.gz are next to each other
+
+	// Note that tlog.TileHashReader can't be used here, because it doesn't
+	// authenticate every tile it returns against the tree hash.
+	v := &cacheVerifier{c: c, ctx: ctx, tree: tree,
+		tiles: make(map[tlog.Tile][]byte), checked: make(map[tlog.Tile]bool)}
+	var failed []tlog.Tile
+	for _, t := range tiles {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if t.H != c.Height() {
+			failed = append(failed, t)
+			continue
+		}
+		if t.W != 1<<t.H {
+			continue // partial tiles are never saved
+		}
+		// The hash of a data tile is its level H node, and the hash of a
+		// level L tile is its level (L+1)*H node.
+		level := (max(t.L, 0) + 1) * t.H
+		if (t.N+1)<<level > tree.N {
+			continue
+		}
+		ok, err := v.check(t)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			failed = append(failed, t)
+		}
+	}
+	return failed, nil
+}
+
+// dataTileHash returns the hash of a full data tile in the format of the Go
+// Checksum Database.
+func dataTileHash(t tlog.Tile, data []byte) (tlog.Hash, error) {
+	hashes := make([]tlog.Hash, 0, t.W)
+	for range t.W {
+		if len(data) == 0 {
+			return tlog.Hash{}, ErrUnexpectedEndOfTile
+		}
+		var entry []byte
+		if idx := bytes.Index(data, []byte("\n\n")); idx >= 0 {
+			entry, data = data[:idx+1], data[idx+2:]
+		} else {
+			entry, data = data, nil
+		}
+		hashes = append(hashes, tlog.RecordHash(entry))
+	}
+	if len(data) != 0 {
+		return tlog.Hash{}, ErrLeftoverData
+	}
+	return subtreeHash(hashes), nil
+}
+
+// hashTileHash returns the hash of a full hash tile.
+func hashTileHash(t tlog.Tile, data []byte) (tlog.Hash, error) {
+	if len(data) != t.W*tlog.HashSize {
+		return tlog.Hash{}, fmt.Errorf("hash tile %s has size %d, want %d", t.Path(), len(data), t.W*tlog.HashSize)
+	}
+	hashes := make([]tlog.Hash, t.W)
+	for i := range hashes {
+		copy(hashes[i][:], data[i*tlog.HashSize:])
+	}
+	return subtreeHash(hashes), nil
+}
+
+// cacheVerifier computes tree hashes from the tiles of a PermanentCache,
+// reading the ones that are missing or don't match from its underlying
+// TileReader. The tiles read from the TileReader are not authenticated, as the
+// resulting tree hash is checked instead.
+type cacheVerifier struct {
+	c     *PermanentCache
+	ctx   context.Context
+	tree  tlog.Tree
+	tiles map[tlog.Tile][]byte
+	// checked records whether each full cached tile matches tree.
+	checked map[tlog.Tile]bool
+	// err is the last error from the underlying TileReader, which is not a
+	// verification failure.
+	err error
+}
+
+// check reports whether the cached full tile t matches the tree.
+//
+// The other tiles needed to compute the tree hash are at higher levels, so
+// checking them first can't lead back to t.
+func (v *cacheVerifier) check(t tlog.Tile) (bool, error) {
+	if ok, done := v.checked[t]; done {
+		return ok, nil
+	}
+	data, err := v.c.readFile(t)
+	if err != nil {
+		v.checked[t] = false
+		return false, nil
+	}
+	var th tlog.Hash
+	if t.L < 0 {
+		th, err = dataTileHash(t, data)
+	} else {
+		th, err = hashTileHash(t, data)
+	}
+	if err != nil {
+		v.checked[t] = false
+		return false, nil
+	}
+	level := (max(t.L, 0) + 1) * t.H
+	h, err := v.treeHash(0, v.tree.N, t.N<<level, (t.N+1)<<level, th)
+	if v.err != nil {
+		return false, v.err
+	}
+	v.checked[t] = err == nil && h == v.tree.Hash
+	return v.checked[t], nil
+}
+
+// treeHash returns the hash of the leaves in [lo, hi), using known as the hash
+// of the complete subtree [klo, khi).
+func (v *cacheVerifier) treeHash(lo, hi, klo, khi int64, known tlog.Hash) (tlog.Hash, error) {
+	if lo == klo && hi == khi {
+		return known, nil
+	}
+	size := hi - lo
+	if size&(size-1) == 0 && (khi <= lo || klo >= hi) {
+		level := bits.TrailingZeros64(uint64(size))
+		return v.storedHash(level, lo>>level)
+	}
+	k := int64(1) << (bits.Len64(uint64(size-1)) - 1)
+	left, err := v.treeHash(lo, lo+k, klo, khi, known)
+	if err != nil {
+		return tlog.Hash{}, err
+	}
+	right, err := v.treeHash(lo+k, hi, klo, khi, known)
+	if err != nil {
+		return tlog.Hash{}, err
+	}
+	return tlog.NodeHash(left, right), nil
+}
+
+// storedHash reads the hash of the complete subtree at the given level and
+// index from the tile that contains it.
+func (v *cacheVerifier) storedHash(level int, n int64) (tlog.Hash, error) {
+	h := v.c.Height()
+	t := tlog.Tile{H: h, L: level / h}
+	t.N = n << (level - t.L*h) >> h
+	t.W = int(min(1<<h, v.tree.N>>(t.L*h)-t.N<<h))
+	data, ok := v.tiles[t]
+	if !ok {
+		// Only use a cached tile once it was checked, so that if it's corrupt
+		// it doesn't cause the tile being checked to fail, too.
+		var err error
+		if t.W != 1<<h {
+			err = os.ErrNotExist // partial tiles are never saved
+		} else if ok, cerr := v.check(t); cerr != nil {
+			return tlog.Hash{}, cerr
+		} else if !ok {
+			err = errors.New("cached tile doesn't match")
+		} else {
+			data, err = v.c.readFile(t)
+		}
+		if err != nil {
+			d, err := readTiles(v.ctx, v.c.tr, []tlog.Tile{t})
+			if err != nil {
+				v.err = err
+				return tlog.Hash{}, err
+			}
+			data = d[0]
+		}
+		v.tiles[t] = data
+	}
+	if len(data) != t.W*tlog.HashSize {
+		return tlog.Hash{}, fmt.Errorf("hash tile %s has size %d, want %d", t.Path(), len(data), t.W*tlog.HashSize)
+	}
+	return tlog.HashFromTile(t, data, tlog.StoredHashIndex(level, n))
+}
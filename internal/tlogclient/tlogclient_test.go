@@ -1,12 +1,29 @@
 package tlogclient_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"filippo.io/litetlog/internal/tlogclient"
+	"filippo.io/litetlog/internal/tlogx"
+	"golang.org/x/mod/sumdb/note"
 	"golang.org/x/mod/sumdb/tlog"
 )
 
@@ -19,7 +36,19 @@ InZSsRXdXKTMF3W5wEcd9T6ro5zyOiRMGQsEPSTco6U=
 	if err != nil {
 		t.Fatal(err)
 	}
+	testEntriesScenarios(t, "https://sum.golang.org/", tree)
+}
+
+// TestTileServer runs the same scenarios as TestSumDB against a local server,
+// so they don't depend on the network or on a moving production log.
+func TestTileServer(t *testing.T) {
+	tl, tree := newTestLog(t, 10037)
+	srv := httptest.NewServer(tl)
+	t.Cleanup(srv.Close)
+	testEntriesScenarios(t, srv.URL, tree)
+}
 
+func testEntriesScenarios(t *testing.T, base string, tree tlog.Tree) {
 	handler, _ := testLogHandler(t)
 
 	tests := []struct {
@@ -27,21 +56,21 @@ InZSsRXdXKTMF3W5wEcd9T6ro5zyOiRMGQsEPSTco6U=
 		expect int
 	}{
 		{0, 1000},
-		{100000, 1000},
-		{31048497 - 1000, 1000 - 31048497%256},    // Stop before the partial.
-		{31048497 - 31048497%256, 31048497 % 256}, // Consume the partial.
-		{31048497, 0},
+		{tree.N / 3, 1000},
+		{tree.N - 1000, 1000 - int(tree.N%256)},  // Stop before the partial.
+		{tree.N - tree.N%256, int(tree.N % 256)}, // Consume the partial.
+		{tree.N, 0},
 	}
 
 	for _, tt := range tests {
 		t.Run(fmt.Sprintf("Start%d", tt.start), func(t *testing.T) {
 			t.Run("NoCache", func(t *testing.T) {
-				fetcher := tlogclient.NewSumDBFetcher("https://sum.golang.org/")
+				fetcher := tlogclient.NewSumDBFetcher(base)
 				fetcher.SetLogger(slog.New(handler))
 				client := tlogclient.NewClient(fetcher)
 
 				count := 0
-				for range client.EntriesSumDB(tree, tt.start) {
+				for range client.EntriesSumDB(context.Background(), tree, tt.start) {
 					count++
 					if count >= 1000 {
 						break
@@ -56,14 +85,14 @@ InZSsRXdXKTMF3W5wEcd9T6ro5zyOiRMGQsEPSTco6U=
 			})
 
 			t.Run("DirCache", func(t *testing.T) {
-				fetcher := tlogclient.NewSumDBFetcher("https://sum.golang.org/")
+				fetcher := tlogclient.NewSumDBFetcher(base)
 				fetcher.SetLogger(slog.New(handler))
 				dirCache := tlogclient.NewPermanentCache(fetcher, t.TempDir())
 				dirCache.SetLogger(slog.New(handler))
 				client := tlogclient.NewClient(dirCache)
 
 				count := 0
-				for range client.EntriesSumDB(tree, tt.start) {
+				for range client.EntriesSumDB(context.Background(), tree, tt.start) {
 					count++
 					if count >= 1000 {
 						break
@@ -79,7 +108,7 @@ InZSsRXdXKTMF3W5wEcd9T6ro5zyOiRMGQsEPSTco6U=
 				// Again, from cache.
 				client = tlogclient.NewClient(dirCache)
 				count = 0
-				for range client.EntriesSumDB(tree, tt.start) {
+				for range client.EntriesSumDB(context.Background(), tree, tt.start) {
 					count++
 					if count >= 1000 {
 						break
@@ -96,6 +125,1384 @@ InZSsRXdXKTMF3W5wEcd9T6ro5zyOiRMGQsEPSTco6U=
 	}
 }
 
+func TestTreeShrunk(t *testing.T) {
+	tl, tree := newTestLog(t, 1000)
+	client := tlogclient.NewClient(tl)
+	for range client.EntriesSumDB(context.Background(), tree, 2000) {
+		t.Fatal("unexpected entry")
+	}
+	if err := client.Error(); !errors.Is(err, tlogclient.ErrTreeShrunk) {
+		t.Errorf("got %v, want ErrTreeShrunk", err)
+	}
+}
+
+func TestVerifyConsistency(t *testing.T) {
+	tl, tree := newTestLog(t, 1000)
+	client := tlogclient.NewClient(tl)
+	for _, n := range []int64{0, 1, 255, 256, 500, 1000} {
+		h, err := tlog.TreeHash(n, tl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		old := tlog.Tree{N: n, Hash: h}
+		if err := client.VerifyConsistency(context.Background(), old, tree); err != nil {
+			t.Errorf("size %d: %v", n, err)
+		}
+	}
+
+	for _, old := range []tlog.Tree{
+		{N: 500, Hash: tlog.Hash{1}},
+		{N: 1000, Hash: tlog.Hash{1}},
+		{N: 2000, Hash: tree.Hash},
+	} {
+		err := client.VerifyConsistency(context.Background(), old, tree)
+		if !errors.Is(err, tlogclient.ErrTreeInconsistent) {
+			t.Errorf("size %d: got %v, want ErrTreeInconsistent", old.N, err)
+		}
+	}
+}
+
+func TestDetectFork(t *testing.T) {
+	tl, tree := newTestLog(t, 1000)
+	fork := &testLog{}
+	for i := range int64(1200) {
+		entry := []byte(fmt.Sprintf("entry %d\nsecond line\n", i))
+		if i == 300 {
+			entry = []byte("forked\n")
+		}
+		hashes, err := tlog.StoredHashes(i, entry, fork)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fork.entries = append(fork.entries, entry)
+		fork.hashes = append(fork.hashes, hashes...)
+	}
+	treeHash := func(l *testLog, n int64) tlog.Tree {
+		h, err := tlog.TreeHash(n, l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tlog.Tree{N: n, Hash: h}
+	}
+
+	skey, vkey, err := note.GenerateKey(rand.Reader, "example.com/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := note.NewSigner(skey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := note.NewVerifier(vkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(tree tlog.Tree) []byte {
+		signed, err := tlogx.SignCheckpoint("example.com/log", tree, "", signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	client := tlogclient.NewClient(tl)
+	if e, err := client.DetectFork(context.Background(), sign(tree), sign(treeHash(tl, 500)), verifier); err != nil || e != nil {
+		t.Errorf("consistent checkpoints: got %v, %v", e, err)
+	}
+
+	// The log serves the forked view to the client.
+	client = tlogclient.NewClient(fork)
+	old, forked := sign(tree), sign(treeHash(fork, 1200))
+	e, err := client.DetectFork(context.Background(), forked, old, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e == nil {
+		t.Fatal("fork not detected")
+	}
+	if !bytes.Equal(e.Old, old) || !bytes.Equal(e.New, forked) || e.OldTree != tree || e.NewTree.N != 1200 {
+		t.Errorf("unexpected evidence %+v", e)
+	}
+	if len(e.Proof) == 0 {
+		t.Errorf("missing consistency proof")
+	}
+
+	e, err = client.DetectFork(context.Background(), old, sign(treeHash(fork, 1000)), verifier)
+	if err != nil || e == nil {
+		t.Errorf("same size fork: got %v, %v", e, err)
+	} else if len(e.Proof) != 0 {
+		t.Errorf("unexpected consistency proof for same size fork")
+	}
+
+	_, otherKey, err := note.GenerateKey(rand.Reader, "example.com/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherVerifier, err := note.NewVerifier(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.DetectFork(context.Background(), old, forked, otherVerifier); err == nil {
+		t.Errorf("expected verification error")
+	}
+}
+
+func TestTail(t *testing.T) {
+	tl, tree := newTestLog(t, 1000)
+	var trees []tlog.Tree
+	for _, n := range []int64{500, 500, 700, 1000} {
+		h, err := tlog.TreeHash(n, tl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trees = append(trees, tlog.Tree{N: n, Hash: h})
+	}
+	fetch := func(ctx context.Context) (tlog.Tree, error) {
+		if len(trees) == 0 {
+			return tree, nil
+		}
+		tree := trees[0]
+		trees = trees[1:]
+		return tree, nil
+	}
+
+	client := tlogclient.NewClient(tl)
+	n := int64(100)
+	for i := range client.Tail(context.Background(), fetch, 100) {
+		if i != n {
+			t.Fatalf("got entry %d, want %d", i, n)
+		}
+		n++
+		if i == tree.N-1 {
+			break
+		}
+	}
+	if err := client.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if n != tree.N {
+		t.Errorf("got entries up to %d, want %d", n, tree.N)
+	}
+
+	// A checkpoint inconsistent with the previous one stops iteration.
+	trees = []tlog.Tree{tree, {N: 1000, Hash: tlog.Hash{1}}}
+	client = tlogclient.NewClient(tl)
+	for range client.Tail(context.Background(), fetch, 0) {
+	}
+	if err := client.Error(); !errors.Is(err, tlogclient.ErrTreeInconsistent) {
+		t.Errorf("got %v, want ErrTreeInconsistent", err)
+	}
+
+	// Cancelling the context while waiting for new entries stops iteration.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client = tlogclient.NewClient(tl)
+	client.SetIncludePartial(true)
+	for i := range client.Tail(ctx, fetch, 0) {
+		if i == tree.N-1 {
+			cancel()
+		}
+	}
+	if err := client.Error(); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestEntriesReverse(t *testing.T) {
+	tl, tree := newTestLog(t, 15000)
+	for _, tt := range []struct {
+		start, end int64
+	}{
+		{0, 14848},
+		{1000, 14848},
+		{14848, 15000},
+		{14900, 15000},
+		{15000, 15000},
+	} {
+		t.Run(fmt.Sprint(tt.start), func(t *testing.T) {
+			client := tlogclient.NewClient(tl)
+			next := tt.end - 1
+			for i, e := range client.EntriesReverse(context.Background(), tree, tt.start) {
+				if i != next {
+					t.Fatalf("got entry %d, want %d", i, next)
+				}
+				if !bytes.Equal(e, tl.entries[i]) {
+					t.Fatalf("entry %d: got %q, want %q", i, e, tl.entries[i])
+				}
+				next--
+			}
+			if err := client.Error(); err != nil {
+				t.Fatal(err)
+			}
+			if next != tt.start-1 {
+				t.Errorf("stopped at %d, want %d", next+1, tt.start)
+			}
+		})
+	}
+}
+
+func TestEntriesFromCheckpoint(t *testing.T) {
+	tl, tree := newTestLog(t, 1000)
+	skey, vkey, err := note.GenerateKey(rand.Reader, "example.com/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := note.NewSigner(skey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := note.NewVerifier(vkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := tlogx.SignCheckpoint("example.com/log", tree, "", signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := tlogclient.NewClient(tl)
+	var n int64
+	for i := range client.EntriesFromCheckpoint(context.Background(), signed, verifier, 0) {
+		if i != n {
+			t.Fatalf("got entry %d, want %d", i, n)
+		}
+		n++
+	}
+	if err := client.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 768 {
+		t.Errorf("got %d entries, want 768", n)
+	}
+
+	_, otherKey, err := note.GenerateKey(rand.Reader, "example.com/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherVerifier, err := note.NewVerifier(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = tlogclient.NewClient(tl)
+	for range client.EntriesFromCheckpoint(context.Background(), signed, otherVerifier, 0) {
+		t.Fatal("unexpected entry")
+	}
+	if err := client.Error(); err == nil {
+		t.Error("expected verification error")
+	}
+
+	// The origin must match the verifier name.
+	signed, err = tlogx.SignCheckpoint("example.com/other", tree, "", signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = tlogclient.NewClient(tl)
+	for range client.EntriesFromCheckpoint(context.Background(), signed, verifier, 0) {
+		t.Fatal("unexpected entry")
+	}
+	if err := client.Error(); err == nil {
+		t.Error("expected origin mismatch error")
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	tl, tree := newTestLog(t, 1000)
+	client := tlogclient.NewClient(tl)
+	var last int64
+	err := tlogclient.Warmup(context.Background(), client, tree, func(done, total int64) {
+		if done != last+1 || total != tree.N {
+			t.Fatalf("got progress %d/%d after %d", done, total, last)
+		}
+		last = done
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != 768 {
+		t.Errorf("got %d entries, want 768", last)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client = tlogclient.NewClient(tl)
+	err = tlogclient.Warmup(ctx, client, tree, func(done, total int64) {
+		cancel()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestPosition(t *testing.T) {
+	tl, tree := newTestLog(t, 1000)
+	client := tlogclient.NewClient(tl)
+	for i := range client.EntriesSumDB(context.Background(), tree, 100) {
+		if i == 299 {
+			break
+		}
+	}
+	if got := client.Position(); got != 300 {
+		t.Errorf("after break: got position %d, want 300", got)
+	}
+	for range client.EntriesSumDB(context.Background(), tree, client.Position()) {
+	}
+	if got := client.Position(); got != 768 {
+		t.Errorf("after partial tile: got position %d, want 768", got)
+	}
+	for range client.EntriesSumDB(context.Background(), tree, client.Position()) {
+	}
+	if got := client.Position(); got != 1000 {
+		t.Errorf("at end of tree: got position %d, want 1000", got)
+	}
+	if err := client.Error(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIncludePartial(t *testing.T) {
+	tl, tree := newTestLog(t, 1000)
+	client := tlogclient.NewClient(tl)
+	client.SetIncludePartial(true)
+	var n int64
+	for i := range client.EntriesSumDB(context.Background(), tree, 0) {
+		if i != n {
+			t.Fatalf("got entry %d, want %d", i, n)
+		}
+		n++
+	}
+	if err := client.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if n != tree.N {
+		t.Errorf("got %d entries, want %d", n, tree.N)
+	}
+
+	n = tree.N
+	for i := range client.EntriesReverse(context.Background(), tree, 0) {
+		n--
+		if i != n {
+			t.Fatalf("got entry %d, want %d", i, n)
+		}
+	}
+	if err := client.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("reverse iteration stopped at %d", n)
+	}
+}
+
+func TestHashReader(t *testing.T) {
+	tl, tree := newTestLog(t, 1000)
+	client := tlogclient.NewClient(tl)
+	client.SetIncludePartial(true)
+	var calls int
+	client.SetHashReader(func(ctx context.Context, tr tlog.Tree) tlog.HashReader {
+		if tr != tree {
+			t.Errorf("got tree %v, want %v", tr, tree)
+		}
+		return tlog.HashReaderFunc(func(indexes []int64) ([]tlog.Hash, error) {
+			calls++
+			return tl.ReadHashes(indexes)
+		})
+	})
+	var n int64
+	for range client.EntriesSumDB(context.Background(), tree, 0) {
+		n++
+	}
+	if err := client.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if n != tree.N {
+		t.Errorf("got %d entries, want %d", n, tree.N)
+	}
+	if calls == 0 {
+		t.Error("custom HashReader was not used")
+	}
+
+	// Hashes from the custom HashReader are checked against the entries.
+	client = tlogclient.NewClient(tl)
+	client.SetHashReader(func(ctx context.Context, tr tlog.Tree) tlog.HashReader {
+		return tlog.HashReaderFunc(func(indexes []int64) ([]tlog.Hash, error) {
+			return make([]tlog.Hash, len(indexes)), nil
+		})
+	})
+	for range client.EntriesSumDB(context.Background(), tree, 0) {
+		t.Fatal("got entry with bad hashes")
+	}
+	var verr *tlogclient.VerificationError
+	if !errors.As(client.Error(), &verr) {
+		t.Errorf("got error %v, want VerificationError", client.Error())
+	}
+}
+
+func TestVerifiedTilesHook(t *testing.T) {
+	tl, tree := newTestLog(t, 1000)
+	client := tlogclient.NewClient(tl)
+	client.SetIncludePartial(true)
+	mirror := make(map[string][]byte)
+	client.SetVerifiedTilesHook(func(tiles []tlog.Tile, data [][]byte) {
+		for i, tile := range tiles {
+			mirror[tile.Path()] = data[i]
+		}
+	})
+	if err := tlogclient.Warmup(context.Background(), client, tree, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := mirror[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+
+	client = tlogclient.NewClient(tlogclient.NewSumDBFetcher(srv.URL))
+	client.SetIncludePartial(true)
+	var n int64
+	for range client.EntriesSumDB(context.Background(), tree, 0) {
+		n++
+	}
+	if err := client.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if n != tree.N {
+		t.Errorf("got %d entries from the mirror, want %d", n, tree.N)
+	}
+}
+
+func TestTileHeight(t *testing.T) {
+	tl, tree := newTestLog(t, 1000)
+	var paths sync.Map
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths.Store(r.URL.Path, true)
+		tl.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	f := tlogclient.NewSumDBFetcher(srv.URL)
+	f.SetTileHeight(4)
+	client := tlogclient.NewClient(f)
+	client.SetIncludePartial(true)
+	var n int64
+	for i := range client.EntriesSumDB(context.Background(), tree, 0) {
+		if i != n {
+			t.Fatalf("got entry %d, want %d", i, n)
+		}
+		n++
+	}
+	if err := client.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if n != tree.N {
+		t.Errorf("got %d entries, want %d", n, tree.N)
+	}
+	for _, path := range []string{"/tile/4/data/061", "/tile/4/data/062.p/8", "/tile/4/1/002"} {
+		if _, ok := paths.Load(path); !ok {
+			t.Errorf("%s was not fetched", path)
+		}
+	}
+
+	n = tree.N
+	for i := range client.EntriesReverse(context.Background(), tree, 0) {
+		n--
+		if i != n {
+			t.Fatalf("got entry %d, want %d", i, n)
+		}
+	}
+	if err := client.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("reverse iteration stopped at %d", n)
+	}
+}
+
+func TestVerificationFailureHook(t *testing.T) {
+	tl, tree := newTestLog(t, 1000)
+	tl.entries[300] = []byte("tampered\n")
+
+	var called bool
+	client := tlogclient.NewClient(tl)
+	client.SetVerificationFailureHook(func(tile tlog.Tile, index int64, got, want tlog.Hash, entry []byte) {
+		called = true
+		if tile.N != 1 || tile.L != -1 {
+			t.Errorf("unexpected tile %v", tile)
+		}
+		if index != 300 {
+			t.Errorf("got index %d, want 300", index)
+		}
+		if got != tlog.RecordHash(entry) || got == want {
+			t.Errorf("unexpected hashes %v, %v", got, want)
+		}
+		if string(entry) != "tampered\n" {
+			t.Errorf("unexpected entry %q", entry)
+		}
+	})
+	for range client.EntriesSumDB(context.Background(), tree, 0) {
+	}
+	// The tampered entry is in a full tile, so it's also detected as a
+	// mismatch between the data tile and the hash tiles.
+	if err := client.Error(); !errors.Is(err, tlogclient.ErrTileMismatch) {
+		t.Errorf("got %v, want ErrTileMismatch", err)
+	}
+	var verr *tlogclient.VerificationError
+	if !errors.As(client.Error(), &verr) || verr.Index != 300 || verr.Tile.N != 1 {
+		t.Errorf("got %v, want a VerificationError for entry 300", client.Error())
+	}
+	if !called {
+		t.Error("hook not called")
+	}
+}
+
+func TestEntryReader(t *testing.T) {
+	tl, tree := newTestLog(t, 1000)
+	for _, index := range []int64{0, 255, 256, 700, 999} {
+		r := tlogclient.NewEntryReader(context.Background(), tl, tree, index)
+		got, err := io.ReadAll(iotest.OneByteReader(r))
+		if err != nil {
+			t.Errorf("entry %d: %v", index, err)
+		}
+		if !bytes.Equal(got, tl.entries[index]) {
+			t.Errorf("entry %d: got %q, want %q", index, got, tl.entries[index])
+		}
+	}
+
+	tl.entries[300] = []byte("tampered\n")
+	_, err := io.ReadAll(tlogclient.NewEntryReader(context.Background(), tl, tree, 300))
+	var verr *tlogclient.VerificationError
+	if !errors.As(err, &verr) || verr.Index != 300 {
+		t.Errorf("got %v, want a VerificationError for entry 300", err)
+	}
+
+	if _, err := io.ReadAll(tlogclient.NewEntryReader(context.Background(), tl, tree, 1000)); err == nil {
+		t.Error("reading an entry past the tree succeeded")
+	}
+}
+
+func TestAuditMode(t *testing.T) {
+	tl, tree := newTestLog(t, 1000)
+	tl.entries[300] = []byte("tampered\n")
+	tl.entries[301] = []byte("tampered too\n")
+	tl.entries[600] = []byte("tampered\n")
+
+	dir := t.TempDir()
+	client := tlogclient.NewClient(tlogclient.NewPermanentCache(tl, dir))
+	client.SetIncludePartial(true)
+	var failures []int64
+	client.SetAuditMode(func(index int64, err error) bool {
+		failures = append(failures, index)
+		return true
+	})
+	var n int64
+	for i := range client.EntriesSumDB(context.Background(), tree, 0) {
+		if i == 300 || i == 301 || i == 600 {
+			t.Errorf("tampered entry %d was yielded", i)
+		}
+		n++
+	}
+	if n != tree.N-3 {
+		t.Errorf("got %d entries, want %d", n, tree.N-3)
+	}
+	if !slices.Equal(failures, []int64{300, 301, 600}) {
+		t.Errorf("got failures at %v, want 300, 301, and 600", failures)
+	}
+	var verr *tlogclient.VerificationError
+	if err := client.Error(); !errors.As(err, &verr) || verr.Index != 300 {
+		t.Errorf("got %v, want a VerificationError for entry 300", err)
+	}
+	if got := client.Position(); got != tree.N {
+		t.Errorf("got position %d, want %d", got, tree.N)
+	}
+	// Tiles with failures are not cached.
+	if _, err := os.Stat(filepath.Join(dir, "tile/8/data/001")); err == nil {
+		t.Error("tile with failures was cached")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tile/8/data/000")); err != nil {
+		t.Errorf("verified tile was not cached: %v", err)
+	}
+
+	// Returning false stops iteration as usual.
+	client = tlogclient.NewClient(tl)
+	client.SetAuditMode(func(index int64, err error) bool { return index < 301 })
+	// The whole batch of tiles fails, like without audit mode.
+	for i := range client.EntriesSumDB(context.Background(), tree, 0) {
+		t.Fatalf("unexpected entry %d", i)
+	}
+	if err := client.Error(); !errors.As(err, &verr) || verr.Index != 301 {
+		t.Errorf("got %v, want a VerificationError for entry 301", err)
+	}
+}
+
+// BenchmarkEntriesSumDB iterates over a log of only full tiles, and reports
+// how many hash and data tiles are fetched per iteration. Full data tiles are
+// checked against their level 8 hash, so no level 0 hash tiles are fetched.
+func BenchmarkEntriesSumDB(b *testing.B) {
+	tl, tree := newTestLog(b, 256*64)
+	report := func(b *testing.B, tr *countingTileReader) {
+		b.ReportMetric(float64(tr.hashTiles.Load())/float64(b.N), "hashtiles/op")
+		b.ReportMetric(float64(tr.level0Tiles.Load())/float64(b.N), "level0tiles/op")
+		b.ReportMetric(float64(tr.dataTiles.Load())/float64(b.N), "datatiles/op")
+	}
+
+	// Full tiles are verified against their level 8 hash.
+	b.Run("FullTiles", func(b *testing.B) {
+		tr := &countingTileReader{TileReader: tl}
+		for range b.N {
+			client := tlogclient.NewClient(tr)
+			for range client.EntriesSumDB(context.Background(), tree, 0) {
+			}
+			if err := client.Error(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		report(b, tr)
+	})
+
+	// For comparison, reading the same entries as partial tiles, as when
+	// following a log that grows slowly, requires the level 0 hashes.
+	var trees []tlog.Tree
+	for k := range int64(64) {
+		n := k*256 + 255
+		th, err := tlog.TreeHash(n, tl)
+		if err != nil {
+			b.Fatal(err)
+		}
+		trees = append(trees, tlog.Tree{N: n, Hash: th})
+	}
+	b.Run("PartialTiles", func(b *testing.B) {
+		tr := &countingTileReader{TileReader: tl}
+		for range b.N {
+			client := tlogclient.NewClient(tr)
+			client.SetIncludePartial(true)
+			for k, tree := range trees {
+				for range client.EntriesSumDB(context.Background(), tree, int64(k)*256) {
+				}
+			}
+			if err := client.Error(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		report(b, tr)
+	})
+}
+
+func TestFullTilesSkipLevel0(t *testing.T) {
+	tl, tree := newTestLog(t, 256*16)
+	tr := &countingTileReader{TileReader: tl}
+	client := tlogclient.NewClient(tr)
+	var n int64
+	for range client.EntriesSumDB(context.Background(), tree, 0) {
+		n++
+	}
+	if err := client.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if n != tree.N {
+		t.Errorf("got %d entries, want %d", n, tree.N)
+	}
+	if got := tr.level0Tiles.Load(); got != 0 {
+		t.Errorf("fetched %d level 0 hash tiles for full data tiles, want 0", got)
+	}
+
+	// The trailing partial tile needs its level 0 hashes.
+	tl, tree = newTestLog(t, 256*16+10)
+	tr = &countingTileReader{TileReader: tl}
+	client = tlogclient.NewClient(tr)
+	for range client.EntriesSumDB(context.Background(), tree, 256*16) {
+	}
+	if err := client.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if got := tr.level0Tiles.Load(); got == 0 {
+		t.Error("fetched no level 0 hash tiles for a partial data tile")
+	}
+}
+
+type countingTileReader struct {
+	tlog.TileReader
+	hashTiles, level0Tiles, dataTiles atomic.Int64
+}
+
+func (r *countingTileReader) ReadTiles(tiles []tlog.Tile) ([][]byte, error) {
+	for _, t := range tiles {
+		if t.L < 0 {
+			r.dataTiles.Add(1)
+		} else {
+			r.hashTiles.Add(1)
+		}
+		if t.L == 0 {
+			r.level0Tiles.Add(1)
+		}
+	}
+	return r.TileReader.ReadTiles(tiles)
+}
+
+func TestClientStats(t *testing.T) {
+	tl, tree := newTestLog(t, 1000)
+	dirCache := tlogclient.NewPermanentCache(tl, t.TempDir())
+
+	run := func() tlogclient.ClientStats {
+		client := tlogclient.NewClient(dirCache)
+		for range client.EntriesSumDB(context.Background(), tree, 0) {
+		}
+		if err := client.Error(); err != nil {
+			t.Fatal(err)
+		}
+		s := client.Stats()
+		if s.Tiles != s.MemoryHits+s.CacheHits+s.Fetched {
+			t.Errorf("tiles don't add up: %+v", s)
+		}
+		if s.Bytes < s.CacheBytes+s.FetchedBytes {
+			t.Errorf("bytes don't add up: %+v", s)
+		}
+		return s
+	}
+
+	first := run()
+	if first.CacheHits != 0 || first.Fetched == 0 {
+		t.Errorf("unexpected first run stats: %+v", first)
+	}
+	if cs := dirCache.Stats(); first.Fetched != cs.Misses || first.FetchedBytes != cs.FetchedBytes {
+		t.Errorf("client stats %+v don't match cache stats %+v", first, cs)
+	}
+
+	// The second run loads the full tiles from disk, and fetches the rest.
+	second := run()
+	if second.CacheHits == 0 || second.Fetched >= first.Fetched || second.Tiles != first.Tiles {
+		t.Errorf("unexpected second run stats: %+v, first run: %+v", second, first)
+	}
+}
+
+func TestPermanentCacheConcurrentMiss(t *testing.T) {
+	tl, _ := newTestLog(t, 1000)
+	tr := &blockingTileReader{TileReader: tl,
+		called: make(chan struct{}, 10), release: make(chan struct{})}
+	dirCache := tlogclient.NewPermanentCache(tr, t.TempDir())
+
+	tile := tlog.Tile{H: 8, L: -1, N: 1, W: 256}
+	results := make(chan error)
+	read := func() {
+		data, err := dirCache.ReadTiles([]tlog.Tile{tile})
+		if err == nil && len(data[0]) == 0 {
+			err = errors.New("empty tile")
+		}
+		results <- err
+	}
+	go read()
+	<-tr.called
+	go read()
+	// Give the second ReadTiles time to join the pending fetch.
+	time.Sleep(100 * time.Millisecond)
+	close(tr.release)
+
+	for range 2 {
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(tr.called); n != 0 {
+		t.Errorf("got %d extra fetches, want 0", n)
+	}
+}
+
+func TestPermanentCacheConcurrentMissCanceled(t *testing.T) {
+	tl, _ := newTestLog(t, 1000)
+	tr := &blockingTileReader{TileReader: tl,
+		called: make(chan struct{}, 10), release: make(chan struct{})}
+	dirCache := tlogclient.NewPermanentCache(tr, t.TempDir())
+
+	tile := tlog.Tile{H: 8, L: -1, N: 1, W: 256}
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error)
+	go func() {
+		_, err := dirCache.ReadTilesContext(ctx, []tlog.Tile{tile})
+		leader <- err
+	}()
+	<-tr.called
+	waiter := make(chan error)
+	go func() {
+		data, err := dirCache.ReadTilesContext(context.Background(), []tlog.Tile{tile})
+		if err == nil && len(data[0]) == 0 {
+			err = errors.New("empty tile")
+		}
+		waiter <- err
+	}()
+	// Give the second ReadTiles time to join the pending fetch.
+	time.Sleep(100 * time.Millisecond)
+
+	// Canceling the first caller must not fail the second one, which
+	// fetches the tile again.
+	cancel()
+	if err := <-leader; !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+	select {
+	case <-tr.called:
+	case err := <-waiter:
+		t.Fatalf("second ReadTiles returned %v without fetching the tile again", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("tile was not fetched again")
+	}
+	close(tr.release)
+	if err := <-waiter; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPermanentCacheStats(t *testing.T) {
+	tl, _ := newTestLog(t, 1000)
+	dirCache := tlogclient.NewPermanentCache(tl, t.TempDir())
+
+	tiles := []tlog.Tile{{H: 8, L: 0, N: 0, W: 256}, {H: 8, L: -1, N: 0, W: 256}}
+	data, err := dirCache.ReadTiles(tiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirCache.SaveTiles(tiles, data)
+	if _, err := dirCache.ReadTiles(tiles); err != nil {
+		t.Fatal(err)
+	}
+
+	size := int64(len(data[0]) + len(data[1]))
+	got := dirCache.Stats()
+	want := tlogclient.CacheStats{
+		Hits: 2, Misses: 2, HitBytes: size, FetchedBytes: size, Saved: 2,
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestPermanentCacheVerify(t *testing.T) {
+	tl, tree := newTestLog(t, 1000)
+	dir := t.TempDir()
+	dirCache := tlogclient.NewPermanentCache(tl, dir)
+	dirCache.SetCompression(true)
+
+	var tiles []tlog.Tile
+	for n := range int64(3) {
+		tiles = append(tiles, tlog.Tile{H: 8, L: 0, N: n, W: 256}, tlog.Tile{H: 8, L: -1, N: n, W: 256})
+	}
+	data, err := tl.ReadTiles(tiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirCache.SaveTiles(tiles, data)
+	if err := os.WriteFile(filepath.Join(dir, "unrelated.txt"), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	failed, err := dirCache.Verify(context.Background(), tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 0 {
+		t.Errorf("got failed tiles %v, want none", failed)
+	}
+
+	// Replace a data tile with a truncated one, and a hash tile with a
+	// modified one, uncompressed.
+	dirCache.SetCompression(false)
+	for _, name := range []string{"tile/8/data/001.gz", "tile/8/0/002.gz"} {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tampered := slices.Clone(data[4])
+	tampered[0] ^= 1
+	dirCache.SaveTiles([]tlog.Tile{tiles[3], tiles[4]}, [][]byte{data[3][:len(data[3])-10], tampered})
+
+	failed, err = dirCache.Verify(context.Background(), tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []tlog.Tile{tiles[4], tiles[3]}; !slices.Equal(failed, want) {
+		t.Errorf("got failed tiles %v, want %v", failed, want)
+	}
+
+	// Tiles past the end of the tree are ignored.
+	smaller := tlog.Tree{N: 600}
+	smaller.Hash, err = tlog.TreeHash(smaller.N, tl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed, err = dirCache.Verify(context.Background(), smaller)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []tlog.Tile{tiles[3]}; !slices.Equal(failed, want) {
+		t.Errorf("got failed tiles %v, want %v", failed, want)
+	}
+}
+
+func TestPermanentCacheVerifyCorruptSibling(t *testing.T) {
+	// The level 1 hash tile holds the level 8 hashes that are siblings of the
+	// data tiles, so it's used to check them.
+	tl, tree := newTestLog(t, 256*256+1000)
+	dir := t.TempDir()
+	dirCache := tlogclient.NewPermanentCache(tl, dir)
+
+	tiles := []tlog.Tile{{H: 8, L: 1, N: 0, W: 256}}
+	for n := range int64(3) {
+		tiles = append(tiles, tlog.Tile{H: 8, L: -1, N: n, W: 256})
+	}
+	data, err := tl.ReadTiles(tiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[0][tlog.HashSize] ^= 1 // the hash of the second data tile
+	dirCache.SaveTiles(tiles, data)
+
+	failed, err := dirCache.Verify(context.Background(), tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []tlog.Tile{tiles[0]}; !slices.Equal(failed, want) {
+		t.Errorf("got failed tiles %v, want %v", failed, want)
+	}
+}
+
+func TestPermanentCacheCompression(t *testing.T) {
+	tl, _ := newTestLog(t, 2048)
+	dir := t.TempDir()
+	var tiles []tlog.Tile
+	for n := range int64(8) {
+		tiles = append(tiles, tlog.Tile{H: 8, L: -1, N: n, W: 256})
+		tiles = append(tiles, tlog.Tile{H: 8, L: 0, N: n, W: 256})
+	}
+	want, err := tl.ReadTiles(tiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Save the first half uncompressed, and the rest compressed, to check
+	// that compression can be enabled on an existing cache.
+	plain := tlogclient.NewPermanentCache(tl, dir)
+	plain.SaveTiles(tiles[:8], want[:8])
+	compressed := tlogclient.NewPermanentCache(tl, dir)
+	compressed.SetCompression(true)
+	data, err := compressed.ReadTiles(tiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed.SaveTiles(tiles, data)
+	if s := compressed.Stats(); s.Hits != 8 || s.Misses != 8 || s.Saved != 8 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	var plainSize, gzSize int
+	for i, tile := range tiles {
+		path := filepath.Join(dir, tile.Path())
+		_, errPlain := os.Stat(path)
+		fi, errGz := os.Stat(path + ".gz")
+		if i < 8 && (errPlain != nil || errGz == nil) {
+			t.Errorf("%s: expected only an uncompressed file", tile.Path())
+		}
+		if i >= 8 && (errPlain == nil || errGz != nil) {
+			t.Errorf("%s: expected only a compressed file", tile.Path())
+		}
+		if i >= 8 && errGz == nil {
+			plainSize += len(want[i])
+			gzSize += int(fi.Size())
+		}
+	}
+	// Hash tiles are random-looking and barely compress, but data tiles,
+	// especially sumdb ones, shrink significantly.
+	t.Logf("compressed %d bytes of tiles to %d bytes", plainSize, gzSize)
+	if gzSize >= plainSize {
+		t.Errorf("compressed tiles are not smaller: %d >= %d", gzSize, plainSize)
+	}
+
+	// Read everything back from disk only.
+	cached := tlogclient.NewPermanentCache(failingTileReader{tl}, dir)
+	data, err = cached.ReadTiles(tiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range tiles {
+		if !bytes.Equal(data[i], want[i]) {
+			t.Errorf("%s: got different data from cache", tiles[i].Path())
+		}
+	}
+}
+
+type failingTileReader struct {
+	tlog.TileReader
+}
+
+func (failingTileReader) ReadTiles(tiles []tlog.Tile) ([][]byte, error) {
+	return nil, errors.New("unexpected read from the underlying TileReader")
+}
+
+type blockingTileReader struct {
+	tlog.TileReader
+	called  chan struct{}
+	release chan struct{}
+}
+
+func (r *blockingTileReader) ReadTiles(tiles []tlog.Tile) ([][]byte, error) {
+	r.called <- struct{}{}
+	<-r.release
+	return r.TileReader.ReadTiles(tiles)
+}
+
+func (r *blockingTileReader) ReadTilesContext(ctx context.Context, tiles []tlog.Tile) ([][]byte, error) {
+	r.called <- struct{}{}
+	select {
+	case <-r.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return r.TileReader.ReadTiles(tiles)
+}
+
+func TestBatchTimeout(t *testing.T) {
+	tl, tree := newTestLog(t, 1000)
+	var stuck atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if stuck.Load() {
+			<-r.Context().Done()
+			return
+		}
+		tl.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	client := tlogclient.NewClient(tlogclient.NewSumDBFetcher(srv.URL))
+	client.SetBatchTimeout(5 * time.Second)
+	for range client.EntriesSumDB(context.Background(), tree, 0) {
+	}
+	if err := client.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	stuck.Store(true)
+	client = tlogclient.NewClient(tlogclient.NewSumDBFetcher(srv.URL))
+	client.SetBatchTimeout(50 * time.Millisecond)
+	for range client.EntriesSumDB(context.Background(), tree, 0) {
+		t.Fatal("unexpected entry")
+	}
+	if err := client.Error(); !errors.Is(err, tlogclient.ErrBatchTimeout) {
+		t.Errorf("got %v, want ErrBatchTimeout", err)
+	}
+}
+
+func TestTileFetcherContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(srv.Close)
+
+	fetcher := tlogclient.NewSumDBFetcher(srv.URL)
+	dirCache := tlogclient.NewPermanentCache(fetcher, t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	_, err := dirCache.ReadTilesContext(ctx, []tlog.Tile{{H: 8, L: 0, N: 0, W: 256}})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestTileFetcherDuplicateTiles(t *testing.T) {
+	tl, _ := newTestLog(t, 1024)
+	var gets atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gets.Add(1)
+		tl.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	a := tlog.Tile{H: 8, L: 0, N: 1, W: 256}
+	b := tlog.Tile{H: 8, L: -1, N: 1, W: 256}
+	tiles := []tlog.Tile{a, b, a, a}
+	want, err := tl.ReadTiles(tiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := tlogclient.NewSumDBFetcher(srv.URL).ReadTiles(tiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range tiles {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("%s: got %q, want %q", tiles[i].Path(), got[i], want[i])
+		}
+	}
+	if n := gets.Load(); n != 2 {
+		t.Errorf("got %d GET requests, want 2", n)
+	}
+}
+
+func TestTileFetcherConditionalRequests(t *testing.T) {
+	tl, _ := newTestLog(t, 1024)
+	var full, notModified atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tile, err := tlog.ParseTilePath(strings.TrimPrefix(r.URL.Path, "/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		data, err := tl.ReadTiles([]tlog.Tile{tile})
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		etag := fmt.Sprintf(`"%x"`, sha256.Sum256(data[0]))
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full.Add(1)
+		w.Write(data[0])
+	}))
+	t.Cleanup(srv.Close)
+
+	f := tlogclient.NewSumDBFetcher(srv.URL)
+	f.SetConditionalRequests(true)
+	for _, tile := range []tlog.Tile{
+		{H: 8, L: -1, N: 3, W: 100}, // fetched
+		{H: 8, L: -1, N: 3, W: 100}, // not modified
+		{H: 8, L: -1, N: 3, W: 200}, // fetched, different width
+		{H: 8, L: -1, N: 3, W: 200}, // not modified
+		{H: 8, L: -1, N: 2, W: 256}, // full tiles are always fetched
+		{H: 8, L: -1, N: 2, W: 256},
+	} {
+		want, err := tl.ReadTiles([]tlog.Tile{tile})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := f.ReadTiles([]tlog.Tile{tile})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got[0], want[0]) {
+			t.Errorf("%s: got %q, want %q", tile.Path(), got[0], want[0])
+		}
+	}
+	if n := full.Load(); n != 4 {
+		t.Errorf("got %d full responses, want 4", n)
+	}
+	if n := notModified.Load(); n != 2 {
+		t.Errorf("got %d not modified responses, want 2", n)
+	}
+}
+
+func TestTileFetcherError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+
+	tile := tlog.Tile{H: 8, L: 0, N: 0, W: 256}
+	_, err := tlogclient.NewSumDBFetcher(srv.URL).ReadTiles([]tlog.Tile{tile})
+	var ferr *tlogclient.FetchError
+	if !errors.As(err, &ferr) {
+		t.Fatalf("got %v, want a FetchError", err)
+	}
+	if ferr.Tile != tile || ferr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got tile %v and status %d", ferr.Tile, ferr.StatusCode)
+	}
+	if want := "tile/8/0/000: unexpected status code 503"; err.Error() != want {
+		t.Errorf("got error %q, want %q", err, want)
+	}
+}
+
+func TestTileFetcherNonTileContent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/data/") {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			io.WriteString(w, "<html><body>Please log in to continue.</body></html>")
+			return
+		}
+		w.Write(make([]byte, 100*tlog.HashSize)) // too short
+	}))
+	t.Cleanup(srv.Close)
+
+	for _, tile := range []tlog.Tile{
+		{H: 8, L: -1, N: 0, W: 256},
+		{H: 8, L: 0, N: 0, W: 256},
+	} {
+		_, err := tlogclient.NewSumDBFetcher(srv.URL).ReadTiles([]tlog.Tile{tile})
+		if !errors.Is(err, tlogclient.ErrNonTileContent) {
+			t.Errorf("%s: got %v, want ErrNonTileContent", tile.Path(), err)
+		}
+	}
+
+	// A partial hash tile of the right size is accepted.
+	tile := tlog.Tile{H: 8, L: 0, N: 0, W: 100}
+	if _, err := tlogclient.NewSumDBFetcher(srv.URL).ReadTiles([]tlog.Tile{tile}); err != nil {
+		t.Errorf("%s: %v", tile.Path(), err)
+	}
+}
+
+func TestTileFetcherCircuitBreaker(t *testing.T) {
+	tl, _ := newTestLog(t, 1000)
+	var down atomic.Bool
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if down.Load() {
+			http.Error(w, "oops", http.StatusServiceUnavailable)
+			return
+		}
+		tl.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	f := tlogclient.NewSumDBFetcher(srv.URL)
+	f.SetCircuitBreaker(3, time.Minute, 100*time.Millisecond)
+	tile := []tlog.Tile{{H: 8, L: 0, N: 0, W: 256}}
+
+	down.Store(true)
+	for range 3 {
+		if _, err := f.ReadTiles(tile); errors.Is(err, tlogclient.ErrCircuitOpen) {
+			t.Fatal("circuit breaker opened too early")
+		}
+	}
+	if _, err := f.ReadTiles(tile); !errors.Is(err, tlogclient.ErrCircuitOpen) {
+		t.Fatalf("got %v, want ErrCircuitOpen", err)
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("got %d requests, want 3", n)
+	}
+
+	// After the cooldown, a failed probe opens the breaker again.
+	time.Sleep(150 * time.Millisecond)
+	if _, err := f.ReadTiles(tile); err == nil || errors.Is(err, tlogclient.ErrCircuitOpen) {
+		t.Fatalf("got %v, want a failed probe", err)
+	}
+	if _, err := f.ReadTiles(tile); !errors.Is(err, tlogclient.ErrCircuitOpen) {
+		t.Fatalf("got %v, want ErrCircuitOpen", err)
+	}
+
+	// A successful probe closes it.
+	down.Store(false)
+	time.Sleep(150 * time.Millisecond)
+	for range 2 {
+		if _, err := f.ReadTiles(tile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := requests.Load(); n != 6 {
+		t.Errorf("got %d requests, want 6", n)
+	}
+}
+
+func TestTileFetcherCircuitBreakerLateResult(t *testing.T) {
+	tl, _ := newTestLog(t, 1000)
+	arrived := make(chan string, 2)
+	gates := map[string]chan struct{}{
+		"/tile/8/0/001": make(chan struct{}), // slow, then succeeds
+		"/tile/8/0/002": make(chan struct{}), // slow, then fails
+	}
+	release := make(map[string]func())
+	for path, c := range gates {
+		release[path] = sync.OnceFunc(func() { close(c) })
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, ok := gates[r.URL.Path]; ok {
+			arrived <- r.URL.Path
+			<-c
+			if r.URL.Path == "/tile/8/0/001" {
+				tl.ServeHTTP(w, r)
+				return
+			}
+		}
+		http.Error(w, "oops", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() {
+		for _, r := range release {
+			r()
+		}
+	})
+
+	f := tlogclient.NewSumDBFetcher(srv.URL)
+	f.SetCircuitBreaker(3, time.Minute, 100*time.Millisecond)
+	read := func(n int64) chan error {
+		errc := make(chan error, 1)
+		go func() {
+			_, err := f.ReadTiles([]tlog.Tile{{H: 8, L: 0, N: n, W: 256}})
+			errc <- err
+		}()
+		return errc
+	}
+
+	// A request starts before the breaker opens.
+	late := read(1)
+	<-arrived
+	for range 3 {
+		<-read(0)
+	}
+	if err := <-read(0); !errors.Is(err, tlogclient.ErrCircuitOpen) {
+		t.Fatalf("got %v, want ErrCircuitOpen", err)
+	}
+
+	// After the cooldown, the probe is in flight when the old request
+	// succeeds, which must not close the breaker.
+	time.Sleep(150 * time.Millisecond)
+	probe := read(2)
+	<-arrived
+	release["/tile/8/0/001"]()
+	if err := <-late; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-read(0); !errors.Is(err, tlogclient.ErrCircuitOpen) {
+		t.Fatalf("got %v after a late success, want ErrCircuitOpen", err)
+	}
+
+	// The probe fails, and the breaker opens again.
+	release["/tile/8/0/002"]()
+	if err := <-probe; err == nil || errors.Is(err, tlogclient.ErrCircuitOpen) {
+		t.Fatalf("got %v, want a failed probe", err)
+	}
+	if err := <-read(0); !errors.Is(err, tlogclient.ErrCircuitOpen) {
+		t.Fatalf("got %v after a failed probe, want ErrCircuitOpen", err)
+	}
+}
+
+func TestTileFetcherFullTileFallback(t *testing.T) {
+	tl, _ := newTestLog(t, 1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, ".p/") {
+			http.NotFound(w, r) // only serve full tiles
+			return
+		}
+		tl.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	tiles := []tlog.Tile{
+		{H: 8, L: -1, N: 3, W: 100},
+		{H: 8, L: 0, N: 3, W: 100},
+	}
+	want, err := tl.ReadTiles(tiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetcher := tlogclient.NewSumDBFetcher(srv.URL)
+	if _, err := fetcher.ReadTiles(tiles); err == nil {
+		t.Error("expected error without fallback")
+	}
+	fetcher.SetFullTileFallback(true)
+	got, err := fetcher.ReadTiles(tiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range tiles {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("%s: got %q, want %q", tiles[i].Path(), got[i], want[i])
+		}
+	}
+}
+
 func testLogHandler(t testing.TB) (slog.Handler, *slog.LevelVar) {
 	level := &slog.LevelVar{}
 	level.Set(slog.LevelDebug)
@@ -121,3 +1528,81 @@ type writerFunc func(p []byte) (n int, err error)
 func (f writerFunc) Write(p []byte) (n int, err error) {
 	return f(p)
 }
+
+// testLog is an in-memory log that serves sumdb-style tiles.
+type testLog struct {
+	entries [][]byte
+	hashes  []tlog.Hash
+}
+
+func newTestLog(t testing.TB, n int64) (*testLog, tlog.Tree) {
+	l := &testLog{}
+	for i := range n {
+		entry := []byte(fmt.Sprintf("entry %d\nsecond line\n", i))
+		hashes, err := tlog.StoredHashes(i, entry, l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.entries = append(l.entries, entry)
+		l.hashes = append(l.hashes, hashes...)
+	}
+	th, err := tlog.TreeHash(n, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, tlog.Tree{N: n, Hash: th}
+}
+
+func (l *testLog) ReadHashes(indexes []int64) ([]tlog.Hash, error) {
+	hashes := make([]tlog.Hash, 0, len(indexes))
+	for _, idx := range indexes {
+		if idx >= int64(len(l.hashes)) {
+			return nil, fmt.Errorf("index %d out of range", idx)
+		}
+		hashes = append(hashes, l.hashes[idx])
+	}
+	return hashes, nil
+}
+
+func (l *testLog) Height() int { return 8 }
+
+func (l *testLog) ReadTiles(tiles []tlog.Tile) ([][]byte, error) {
+	data := make([][]byte, 0, len(tiles))
+	for _, t := range tiles {
+		d, err := l.readTile(t)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, d)
+	}
+	return data, nil
+}
+
+func (l *testLog) readTile(t tlog.Tile) ([]byte, error) {
+	if t.L >= 0 {
+		return tlog.ReadTileData(t, l)
+	}
+	start := t.N << t.H
+	end := start + int64(t.W)
+	if end > int64(len(l.entries)) {
+		return nil, fmt.Errorf("tile %s out of range", t.Path())
+	}
+	return bytes.Join(l.entries[start:end], []byte("\n")), nil
+}
+
+func (l *testLog) SaveTiles(tiles []tlog.Tile, data [][]byte) {}
+
+// ServeHTTP serves the tiles of the log, like a tlog-tiles server.
+func (l *testLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t, err := tlog.ParseTilePath(strings.TrimPrefix(r.URL.Path, "/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	data, err := l.readTile(t)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(data)
+}
@@ -7,11 +7,14 @@ package tlogx
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
+	"golang.org/x/mod/sumdb/note"
 	"golang.org/x/mod/sumdb/tlog"
 )
 
@@ -47,13 +50,20 @@ func ParseCheckpoint(text string) (Checkpoint, error) {
 
 	lines := strings.SplitN(text, "\n", 4)
 
+	if !isValidOrigin(lines[0]) {
+		return Checkpoint{}, errors.New("malformed checkpoint: invalid origin")
+	}
+
 	n, err := strconv.ParseInt(lines[1], 10, 64)
 	if err != nil || n < 0 || lines[1] != strconv.FormatInt(n, 10) {
 		return Checkpoint{}, errors.New("malformed checkpoint")
 	}
 
-	h, err := base64.StdEncoding.DecodeString(lines[2])
-	if err != nil || len(h) != tlog.HashSize {
+	// Reject non-canonical encodings (including the newlines and carriage
+	// returns ignored by the decoder), so that a checkpoint has only one valid
+	// representation.
+	h, err := base64.StdEncoding.Strict().DecodeString(lines[2])
+	if err != nil || len(h) != tlog.HashSize || strings.ContainsRune(lines[2], '\r') {
 		return Checkpoint{}, errors.New("malformed checkpoint")
 	}
 
@@ -71,7 +81,108 @@ func ParseCheckpoint(text string) (Checkpoint, error) {
 	return Checkpoint{lines[0], tlog.Tree{N: n, Hash: hash}, lines[3]}, nil
 }
 
+// isValidOrigin reports whether origin is a valid checkpoint origin.
+//
+// It's like [isValidName], but it allows interior spaces, because the Go
+// Checksum Database uses "go.sum database tree" as its origin.
+func isValidOrigin(origin string) bool {
+	return origin != "" && utf8.ValidString(origin) && strings.TrimSpace(origin) == origin
+}
+
+// checkpointJSON is the JSON representation of a Checkpoint.
+type checkpointJSON struct {
+	Origin    string   `json:"origin"`
+	Size      int64    `json:"size"`
+	Hash      string   `json:"hash"`
+	Extension []string `json:"extension,omitempty"`
+}
+
+// MarshalJSON encodes the checkpoint as a JSON object like
+//
+//	{
+//		"origin": "example.com/origin",
+//		"size": 923748,
+//		"hash": "nND/nri/U0xuHUrYSy0HtMeal2vzD9V4k/BO79C+QeI=",
+//		"extension": ["foo", "bar"]
+//	}
+//
+// where hash is base64-encoded like in the text form, and extension is the
+// list of extension lines, without newlines, omitted if there are none.
+func (c Checkpoint) MarshalJSON() ([]byte, error) {
+	j := checkpointJSON{
+		Origin: c.Origin,
+		Size:   c.N,
+		Hash:   base64.StdEncoding.EncodeToString(c.Hash[:]),
+	}
+	if c.Extension != "" {
+		j.Extension = strings.Split(strings.TrimSuffix(c.Extension, "\n"), "\n")
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON decodes a checkpoint encoded by [Checkpoint.MarshalJSON]. The
+// result must be a valid checkpoint, as accepted by [ParseCheckpoint].
+func (c *Checkpoint) UnmarshalJSON(data []byte) error {
+	var j checkpointJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	if strings.Contains(j.Origin, "\n") || strings.Contains(j.Hash, "\n") {
+		return errors.New("malformed checkpoint")
+	}
+	var ext string
+	for _, line := range j.Extension {
+		if line == "" || strings.Contains(line, "\n") {
+			return errors.New("malformed checkpoint: invalid extension line")
+		}
+		ext += line + "\n"
+	}
+	text := fmt.Sprintf("%s\n%d\n%s\n%s", j.Origin, j.Size, j.Hash, ext)
+	parsed, err := ParseCheckpoint(text)
+	if err != nil {
+		return err
+	}
+	*c = parsed
+	return nil
+}
+
 func FormatCheckpoint(c Checkpoint) string {
 	return fmt.Sprintf("%s\n%d\n%s\n%s",
 		c.Origin, c.N, base64.StdEncoding.EncodeToString(c.Hash[:]), c.Extension)
 }
+
+// SignCheckpoint formats a checkpoint for the given tree and signs it with
+// signer, returning the encoded note.
+//
+// The origin must be non-empty and not contain newlines, and the extension
+// must be empty or a sequence of non-empty lines, each terminated by a newline.
+func SignCheckpoint(origin string, tree tlog.Tree, extension string, signer note.Signer) ([]byte, error) {
+	if strings.Contains(origin, "\n") {
+		return nil, errors.New("invalid checkpoint origin")
+	}
+	text := FormatCheckpoint(Checkpoint{Origin: origin, Tree: tree, Extension: extension})
+	if _, err := ParseCheckpoint(text); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint: %w", err)
+	}
+	return note.Sign(&note.Note{Text: text}, signer)
+}
+
+// ParseAndVerifyCheckpoint verifies the signed checkpoint note with v, and
+// parses it. The checkpoint origin must match the verifier name.
+//
+// Logs with an origin different from their key name, like the Go Checksum
+// Database, should use [note.Open] and [ParseCheckpoint] instead.
+func ParseAndVerifyCheckpoint(signed []byte, v note.Verifier) (Checkpoint, error) {
+	n, err := note.Open(signed, note.VerifierList(v))
+	if err != nil {
+		return Checkpoint{}, fmt.Errorf("verifying checkpoint: %w", err)
+	}
+	c, err := ParseCheckpoint(n.Text)
+	if err != nil {
+		return Checkpoint{}, fmt.Errorf("parsing checkpoint: %w", err)
+	}
+	if c.Origin != v.Name() {
+		return Checkpoint{}, fmt.Errorf("checkpoint origin %q doesn't match verifier name %q", c.Origin, v.Name())
+	}
+	return c, nil
+}
@@ -0,0 +1,194 @@
+package tlogx_test
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	"filippo.io/litetlog/internal/tlogx"
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+func TestSignCheckpoint(t *testing.T) {
+	skey, vkey, err := note.GenerateKey(rand.Reader, "example.com/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := note.NewSigner(skey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := note.NewVerifier(vkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree := tlog.Tree{N: 42, Hash: tlog.Hash{1, 2, 3}}
+	signed, err := tlogx.SignCheckpoint("example.com/log", tree, "foo\nbar\n", signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := note.Open(signed, note.VerifierList(verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := tlogx.ParseCheckpoint(n.Text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Origin != "example.com/log" || c.Tree != tree || c.Extension != "foo\nbar\n" {
+		t.Errorf("unexpected checkpoint %+v", c)
+	}
+
+	for _, tt := range []struct {
+		origin, extension string
+	}{
+		{"", ""},
+		{" example.com/log", ""},
+		{"example.com/log\n42", ""},
+		{"example.com/log", "foo"},
+		{"example.com/log", "foo\n\nbar\n"},
+	} {
+		if _, err := tlogx.SignCheckpoint(tt.origin, tree, tt.extension, signer); err == nil {
+			t.Errorf("SignCheckpoint(%q, %q) succeeded", tt.origin, tt.extension)
+		}
+	}
+}
+
+func TestParseCheckpointOrigin(t *testing.T) {
+	const rest = "\n42\nAQIDAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\n"
+	for _, origin := range []string{
+		"example.com/log",
+		"go.sum database tree",
+	} {
+		if _, err := tlogx.ParseCheckpoint(origin + rest); err != nil {
+			t.Errorf("ParseCheckpoint with origin %q: %v", origin, err)
+		}
+	}
+	for _, origin := range []string{
+		"",
+		" ",
+		" example.com/log",
+		"example.com/log\t",
+		"example.com/\xff",
+	} {
+		if _, err := tlogx.ParseCheckpoint(origin + rest); err == nil {
+			t.Errorf("ParseCheckpoint with origin %q succeeded", origin)
+		}
+	}
+}
+
+func FuzzParseCheckpoint(f *testing.F) {
+	f.Add("example.com/log\n42\nnND/nri/U0xuHUrYSy0HtMeal2vzD9V4k/BO79C+QeI=\n")
+	f.Add("go.sum database tree\n0\nnND/nri/U0xuHUrYSy0HtMeal2vzD9V4k/BO79C+QeI=\nfoo\nbar\n")
+	f.Add("example.com/log\n42\nnND/nri/U0xuHUrYSy0HtMeal2vzD9V4k/BO79C+QeJ=\n")
+	f.Add("example.com/log\n042\nnND/nri/U0xuHUrYSy0HtMeal2vzD9V4k/BO79C+QeI=\n\n")
+	f.Add(" example.com/log\n-1\n\n")
+	f.Fuzz(func(t *testing.T, text string) {
+		c, err := tlogx.ParseCheckpoint(text)
+		if err != nil {
+			return
+		}
+		if got := tlogx.FormatCheckpoint(c); got != text {
+			t.Errorf("FormatCheckpoint(ParseCheckpoint(%q)) = %q", text, got)
+		}
+	})
+}
+
+func TestParseAndVerifyCheckpoint(t *testing.T) {
+	skey, vkey, err := note.GenerateKey(rand.Reader, "example.com/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := note.NewSigner(skey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := note.NewVerifier(vkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree := tlog.Tree{N: 42, Hash: tlog.Hash{1, 2, 3}}
+	signed, err := tlogx.SignCheckpoint("example.com/log", tree, "", signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := tlogx.ParseAndVerifyCheckpoint(signed, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Origin != "example.com/log" || c.Tree != tree {
+		t.Errorf("unexpected checkpoint %+v", c)
+	}
+
+	// A checkpoint for a different origin, signed by the same key.
+	other, err := tlogx.SignCheckpoint("example.com/other", tree, "", signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tlogx.ParseAndVerifyCheckpoint(other, verifier); err == nil {
+		t.Error("accepted checkpoint with mismatched origin")
+	}
+
+	// A checkpoint signed by a different key.
+	skey2, _, err := note.GenerateKey(rand.Reader, "example.com/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer2, err := note.NewSigner(skey2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed2, err := tlogx.SignCheckpoint("example.com/log", tree, "", signer2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tlogx.ParseAndVerifyCheckpoint(signed2, verifier); err == nil {
+		t.Error("accepted checkpoint signed by unknown key")
+	}
+}
+
+func TestCheckpointJSON(t *testing.T) {
+	for _, c := range []tlogx.Checkpoint{
+		{Origin: "example.com/log", Tree: tlog.Tree{N: 42, Hash: tlog.Hash{1, 2, 3}}},
+		{Origin: "go.sum database tree", Tree: tlog.Tree{N: 0}, Extension: "foo\nbar baz\n"},
+	} {
+		data, err := json.Marshal(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got tlogx.Checkpoint
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatalf("%s: %v", data, err)
+		}
+		if got != c {
+			t.Errorf("%s: got %+v, want %+v", data, got, c)
+		}
+	}
+
+	data, err := json.Marshal(tlogx.Checkpoint{Origin: "example.com/log",
+		Tree: tlog.Tree{N: 42, Hash: tlog.Hash{1, 2, 3}}, Extension: "foo\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"origin":"example.com/log","size":42,"hash":"AQIDAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=","extension":["foo"]}`
+	if string(data) != want {
+		t.Errorf("got %s, want %s", data, want)
+	}
+
+	for _, bad := range []string{
+		`{"origin":"","size":42,"hash":"AQIDAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}`,
+		`{"origin":"a\nb","size":42,"hash":"AQIDAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}`,
+		`{"origin":"example.com/log","size":-1,"hash":"AQIDAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}`,
+		`{"origin":"example.com/log","size":42,"hash":"AQID"}`,
+		`{"origin":"example.com/log","size":42,"hash":"AQIDAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=","extension":[""]}`,
+		`{"origin":"example.com/log","size":42,"hash":"AQIDAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=","extension":["a\nb"]}`,
+	} {
+		var c tlogx.Checkpoint
+		if err := json.Unmarshal([]byte(bad), &c); err == nil {
+			t.Errorf("accepted %s", bad)
+		}
+	}
+}
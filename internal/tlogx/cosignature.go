@@ -6,6 +6,7 @@
 package tlogx
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ed25519"
 	"crypto/sha256"
@@ -13,6 +14,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 	"unicode"
@@ -55,20 +57,78 @@ func NewCosignatureV1Signer(name string, key crypto.Signer) (*CosignatureV1Signe
 		sig = append(sig, s...)
 		return sig, nil
 	}
-	s.verify = func(msg, sig []byte) bool {
-		if len(sig) != 8+ed25519.SignatureSize {
+	s.verify = verifyCosignatureV1(k)
+
+	return s, nil
+}
+
+// NewCosignatureV1Verifier constructs a new note.Verifier for timestamped
+// cosignature/v1 signatures from an encoded verifier key, such as the one
+// returned by [CosignatureV1Signer.VerifierKey].
+func NewCosignatureV1Verifier(vkey string) (note.Verifier, error) {
+	name, vkey := chop(vkey, "+")
+	hash16, key64 := chop(vkey, "+")
+	hash, err1 := strconv.ParseUint(hash16, 16, 32)
+	key, err2 := base64.StdEncoding.DecodeString(key64)
+	// DecodeString ignores newlines and non-zero padding bits, so require the
+	// canonical encoding to reject any trailing garbage.
+	if err2 == nil && base64.StdEncoding.EncodeToString(key) != key64 {
+		err2 = errors.New("non-canonical base64")
+	}
+	if len(hash16) != 8 || err1 != nil || err2 != nil || !isValidName(name) || len(key) == 0 {
+		return nil, errors.New("malformed verifier id")
+	}
+
+	alg, key := key[0], key[1:]
+	if alg != algCosignatureV1 {
+		return nil, errors.New("unknown verifier algorithm")
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("malformed verifier id")
+	}
+	if uint32(hash) != keyHash(name, append([]byte{algCosignatureV1}, key...)) {
+		return nil, errors.New("invalid verifier hash")
+	}
+
+	return &verifier{
+		name:   name,
+		hash:   uint32(hash),
+		verify: verifyCosignatureV1(key),
+		key:    key,
+	}, nil
+}
+
+// verifyCosignatureV1 returns the verification function shared by all
+// cosignature/v1 verifiers, including the one of [CosignatureV1Signer].
+func verifyCosignatureV1(k ed25519.PublicKey) func(msg, sig []byte) bool {
+	return func(msg, sig []byte) bool {
+		t, sig, err := parseCosignatureV1(sig)
+		if err != nil {
 			return false
 		}
-		t := binary.BigEndian.Uint64(sig)
-		sig = sig[8:]
 		m, err := formatCosignatureV1(t, msg)
 		if err != nil {
 			return false
 		}
 		return ed25519.Verify(k, m, sig)
 	}
+}
 
-	return s, nil
+// maxCosignatureSkew is how far in the future the timestamp of a cosignature
+// can be before it's rejected as implausible.
+const maxCosignatureSkew = 24 * time.Hour
+
+// parseCosignatureV1 splits a cosignature/v1 signature into its timestamp and
+// Ed25519 signature, rejecting malformed ones.
+func parseCosignatureV1(sig []byte) (t uint64, edSig []byte, err error) {
+	if len(sig) != 8+ed25519.SignatureSize {
+		return 0, nil, errors.New("malformed cosignature: wrong length")
+	}
+	t = binary.BigEndian.Uint64(sig)
+	if t > uint64(time.Now().Add(maxCosignatureSkew).Unix()) {
+		return 0, nil, errors.New("malformed cosignature: timestamp too far in the future")
+	}
+	return t, sig[8:], nil
 }
 
 func formatCosignatureV1(t uint64, msg []byte) ([]byte, error) {
@@ -114,7 +174,52 @@ func (s *CosignatureV1Signer) Sign(msg []byte) ([]byte, error) { return s.sign(m
 func (s *CosignatureV1Signer) Verifier() note.Verifier         { return &s.verifier }
 
 func (v *verifier) VerifierKey() string {
-	return fmt.Sprintf("%s+%08x+%s", v.name, v.hash, base64.StdEncoding.EncodeToString(v.key))
+	key := append([]byte{algCosignatureV1}, v.key...)
+	return fmt.Sprintf("%s+%08x+%s", v.name, v.hash, base64.StdEncoding.EncodeToString(key))
+}
+
+// CountCosignatures returns the verifiers that produced a valid signature on
+// the signed note n, in the order they appear in verifiers.
+//
+// Unlike [note.Open], it doesn't fail if a signature doesn't verify, or if no
+// signature is from a known key: such signatures are simply not counted. It
+// returns an error only if the note is malformed. It's meant for implementing
+// threshold policies, like "two out of these five witnesses".
+func CountCosignatures(n []byte, verifiers []note.Verifier) ([]note.Verifier, error) {
+	i := bytes.LastIndex(n, []byte("\n\n"))
+	if i < 0 || !utf8.Valid(n) {
+		return nil, errors.New("malformed note")
+	}
+	msg, sigs := n[:i+1], string(n[i+2:])
+	if sigs == "" || !strings.HasSuffix(sigs, "\n") {
+		return nil, errors.New("malformed note")
+	}
+	lines := strings.SplitAfter(sigs[:len(sigs)-1], "\n")
+	if len(lines) > maxSignatures {
+		return nil, errors.New("malformed note: too many signatures")
+	}
+
+	signed := make(map[note.Verifier]bool)
+	for _, line := range lines {
+		name, hash, sig, err := parseSignatureLine(strings.TrimSuffix(line, "\n"))
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range verifiers {
+			if v.Name() == name && v.KeyHash() == hash && v.Verify(msg, sig) {
+				signed[v] = true
+			}
+		}
+	}
+
+	var result []note.Verifier
+	for _, v := range verifiers {
+		if signed[v] {
+			result = append(result, v)
+			delete(signed, v)
+		}
+	}
+	return result, nil
 }
 
 // isValidName reports whether name is valid.
@@ -3,12 +3,31 @@ package tlogx_test
 import (
 	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
 	"testing"
+	"time"
 
 	"filippo.io/litetlog/internal/tlogx"
 	"golang.org/x/mod/sumdb/note"
 )
 
+func TestCosignatureV1VerifierKey(t *testing.T) {
+	k := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	s, err := tlogx.NewCosignatureV1Signer("example.com", k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The key is encoded as the algorithm byte followed by the public key.
+	const want = "example.com+df933d47+BDtqJ7zOtqQtYqOo0CpvDXNlMhV3HeJDpjrASKGLWdop"
+	if got := s.VerifierKey(); got != want {
+		t.Errorf("got verifier key %q, want %q", got, want)
+	}
+}
+
 func TestSignerRoundtrip(t *testing.T) {
 	_, k, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
@@ -30,3 +49,149 @@ func TestSignerRoundtrip(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestCosignatureV1Verifier(t *testing.T) {
+	_, k, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := tlogx.NewCosignatureV1Signer("example.com", k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := tlogx.NewCosignatureV1Verifier(s.VerifierKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Name() != "example.com" || v.KeyHash() != s.KeyHash() {
+		t.Errorf("got verifier %q %08x, want %q %08x", v.Name(), v.KeyHash(), s.Name(), s.KeyHash())
+	}
+
+	msg := "test\n123\nf+7CoKgXKE/tNys9TTXcr/ad6U/K3xvznmzew9y6SP0=\n"
+	n, err := note.Sign(&note.Note{Text: msg}, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := note.Open(n, note.VerifierList(v)); err != nil {
+		t.Fatal(err)
+	}
+
+	// An Ed25519 note key is not a cosignature/v1 key.
+	_, vkey, err := note.GenerateKey(rand.Reader, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tlogx.NewCosignatureV1Verifier(vkey); err == nil {
+		t.Error("NewCosignatureV1Verifier accepted an Ed25519 key")
+	}
+}
+
+func TestCountCosignatures(t *testing.T) {
+	var signers []note.Signer
+	var verifiers []note.Verifier
+	for _, name := range []string{"a.example", "b.example", "c.example"} {
+		_, k, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := tlogx.NewCosignatureV1Signer(name, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers = append(signers, s)
+		verifiers = append(verifiers, s.Verifier())
+	}
+	skey, _, err := note.GenerateKey(rand.Reader, "log.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logSigner, err := note.NewSigner(skey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := "test\n123\nf+7CoKgXKE/tNys9TTXcr/ad6U/K3xvznmzew9y6SP0=\n"
+	n, err := note.Sign(&note.Note{Text: msg}, logSigner, signers[2], signers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := tlogx.CountCosignatures(n, verifiers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signed) != 2 || signed[0] != verifiers[0] || signed[1] != verifiers[2] {
+		t.Errorf("got %d signers, want a.example and c.example", len(signed))
+	}
+
+	// A signature over a different message is not counted.
+	other, err := note.Sign(&note.Note{Text: strings.Replace(msg, "123", "124", 1)}, signers[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherSig, _ := strings.Cut(string(other), "\n\n")
+	signed, err = tlogx.CountCosignatures(append(n, otherSig...), verifiers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signed) != 2 {
+		t.Errorf("got %d signers, want 2", len(signed))
+	}
+
+	if _, err := tlogx.CountCosignatures([]byte(msg), verifiers); err == nil {
+		t.Error("expected error for unsigned note")
+	}
+}
+
+func TestCosignatureV1Malformed(t *testing.T) {
+	_, k, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := tlogx.NewCosignatureV1Signer("example.com", k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := tlogx.NewCosignatureV1Verifier(s.VerifierKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := "test\n123\nf+7CoKgXKE/tNys9TTXcr/ad6U/K3xvznmzew9y6SP0=\n"
+	// cosign produces a note signed at timestamp ts, with the signature
+	// (including the key hash) modified by f.
+	cosign := func(ts uint64, f func([]byte) []byte) []byte {
+		m := fmt.Sprintf("cosignature/v1\ntime %d\ntest\n123\n%s\n",
+			ts, "f+7CoKgXKE/tNys9TTXcr/ad6U/K3xvznmzew9y6SP0=")
+		sig := binary.BigEndian.AppendUint32(nil, s.KeyHash())
+		sig = binary.BigEndian.AppendUint64(sig, ts)
+		sig = append(sig, ed25519.Sign(k, []byte(m))...)
+		return []byte(msg + "\n— example.com " + base64.StdEncoding.EncodeToString(f(sig)) + "\n")
+	}
+	now := uint64(time.Now().Unix())
+	identity := func(sig []byte) []byte { return sig }
+
+	if _, err := note.Open(cosign(now, identity), note.VerifierList(v)); err != nil {
+		t.Fatalf("valid cosignature rejected: %v", err)
+	}
+	for name, n := range map[string][]byte{
+		"truncated":      cosign(now, func(sig []byte) []byte { return sig[:len(sig)-1] }),
+		"over-long":      cosign(now, func(sig []byte) []byte { return append(sig, 0) }),
+		"timestamp only": cosign(now, func(sig []byte) []byte { return sig[:4+8] }),
+		"far future":     cosign(now+365*24*60*60, identity),
+		"max timestamp":  cosign(math.MaxUint64, identity),
+	} {
+		for _, v := range []note.Verifier{v, s.Verifier()} {
+			if _, err := note.Open(n, note.VerifierList(v)); err == nil {
+				t.Errorf("%s: cosignature accepted", name)
+			}
+		}
+	}
+
+	// Verifier keys with trailing garbage are rejected.
+	vkey := s.VerifierKey()
+	for _, bad := range []string{vkey + "\n", vkey + "=", vkey + "AAAA", vkey + "+AAAA"} {
+		if _, err := tlogx.NewCosignatureV1Verifier(bad); err == nil {
+			t.Errorf("NewCosignatureV1Verifier accepted %q", bad)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package tlogx
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// A Log is a small append-only log stored in a directory, in the same format
+// used by the spicy command:
+//
+//   - "latest" is the latest signed checkpoint;
+//   - "edge" is "size N" followed by the [RightEdge] hashes of the tree, one
+//     per line;
+//   - each entry is stored in a file named after its decimal index.
+//
+// A Log is not safe for concurrent use, and only one Log must be open for a
+// given directory at a time.
+type Log struct {
+	dir    string
+	signer note.Signer
+	tree   tlog.Tree
+	origin string
+
+	// edge holds the RightEdge hashes of tree.
+	edge       []tlog.Hash
+	checkpoint []byte
+}
+
+// CreateLog initializes an empty log in dir, which must already exist. The
+// log origin is the signer name.
+func CreateLog(dir string, signer note.Signer) (*Log, error) {
+	for _, name := range []string{"latest", "edge"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return nil, fmt.Errorf("log already initialized, %q exists", filepath.Join(dir, name))
+		}
+	}
+	l := &Log{dir: dir, signer: signer, origin: signer.Name()}
+	if err := l.commit(tlog.Tree{}, nil); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// OpenLog loads a log from dir, verifying the latest checkpoint with verifier.
+// New checkpoints are signed with signer.
+func OpenLog(dir string, signer note.Signer, verifier note.Verifier) (*Log, error) {
+	checkpoint, err := os.ReadFile(filepath.Join(dir, "latest"))
+	if err != nil {
+		return nil, fmt.Errorf("could not read latest checkpoint: %w", err)
+	}
+	c, err := ParseAndVerifyCheckpoint(checkpoint, verifier)
+	if err != nil {
+		return nil, fmt.Errorf("invalid latest checkpoint: %w", err)
+	}
+
+	edge, err := os.ReadFile(filepath.Join(dir, "edge"))
+	if err != nil {
+		return nil, fmt.Errorf("could not read edge file: %w", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(edge)), "\n")
+	size, ok := strings.CutPrefix(lines[0], "size ")
+	if !ok {
+		return nil, fmt.Errorf("malformed edge file: %q", lines[0])
+	}
+	if n, err := strconv.ParseInt(size, 10, 64); err != nil {
+		return nil, fmt.Errorf("malformed edge file: %w", err)
+	} else if n != c.N {
+		return nil, fmt.Errorf("edge file size mismatch: got %d, latest checkpoint is %d", n, c.N)
+	}
+	var hashes []tlog.Hash
+	for _, line := range lines[1:] {
+		hash, err := tlog.ParseHash(line)
+		if err != nil {
+			return nil, fmt.Errorf("malformed edge file: %w", err)
+		}
+		hashes = append(hashes, hash)
+	}
+	if _, _, th, err := AppendToEdge(c.N, hashes, nil); err != nil {
+		return nil, fmt.Errorf("malformed edge file: %w", err)
+	} else if th != c.Hash {
+		return nil, errors.New("edge file doesn't match latest checkpoint")
+	}
+	return &Log{dir: dir, signer: signer, tree: c.Tree, origin: c.Origin,
+		edge: hashes, checkpoint: checkpoint}, nil
+}
+
+// Origin returns the log origin.
+func (l *Log) Origin() string {
+	return l.origin
+}
+
+// Tree returns the current tree of the log.
+func (l *Log) Tree() tlog.Tree {
+	return l.tree
+}
+
+// Checkpoint returns the latest signed checkpoint of the log.
+func (l *Log) Checkpoint() []byte {
+	return l.checkpoint
+}
+
+// Append adds entries to the log, and signs a single new checkpoint. It
+// returns the index of the first entry, and the inclusion proof of each entry
+// in the tree of the new checkpoint, returned by [Log.Checkpoint].
+func (l *Log) Append(entries ...[]byte) (index int64, proofs []tlog.RecordProof, err error) {
+	index = l.tree.N
+	n, edge, th, err := AppendToEdge(index, l.edge, entries)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// The old right edge and the hashes of the new entries are all that's
+	// needed to prove the new entries.
+	hashes := make(map[int64]tlog.Hash)
+	for i, id := range RightEdge(index) {
+		hashes[id] = l.edge[i]
+	}
+	hashReader := tlog.HashReaderFunc(func(indexes []int64) ([]tlog.Hash, error) {
+		list := make([]tlog.Hash, 0, len(indexes))
+		for _, id := range indexes {
+			h, ok := hashes[id]
+			if !ok {
+				return nil, fmt.Errorf("index %d not in hashes", id)
+			}
+			list = append(list, h)
+		}
+		return list, nil
+	})
+	for i, entry := range entries {
+		hh, err := tlog.StoredHashes(index+int64(i), entry, hashReader)
+		if err != nil {
+			return 0, nil, err
+		}
+		for k, h := range hh {
+			hashes[tlog.StoredHashIndex(0, index+int64(i))+int64(k)] = h
+		}
+	}
+	for i := range entries {
+		proof, err := tlog.ProveRecord(n, index+int64(i), hashReader)
+		if err != nil {
+			return 0, nil, err
+		}
+		proofs = append(proofs, proof)
+	}
+
+	for i, entry := range entries {
+		entryPath := filepath.Join(l.dir, strconv.FormatInt(index+int64(i), 10))
+		if err := os.WriteFile(entryPath, entry, 0644); err != nil {
+			return 0, nil, fmt.Errorf("could not write entry: %w", err)
+		}
+	}
+	if err := l.commit(tlog.Tree{N: n, Hash: th}, edge); err != nil {
+		return 0, nil, err
+	}
+	return index, proofs, nil
+}
+
+// commit signs a checkpoint for tree, and writes it and the new edge to disk.
+func (l *Log) commit(tree tlog.Tree, edge []tlog.Hash) error {
+	checkpoint, err := SignCheckpoint(l.origin, tree, "", l.signer)
+	if err != nil {
+		return fmt.Errorf("could not sign checkpoint: %w", err)
+	}
+	newEdge := fmt.Sprintf("size %d\n", tree.N)
+	for _, h := range edge {
+		newEdge += fmt.Sprintf("%s\n", h)
+	}
+	if err := os.WriteFile(filepath.Join(l.dir, "latest"), checkpoint, 0644); err != nil {
+		return fmt.Errorf("could not write checkpoint: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(l.dir, "edge"), []byte(newEdge), 0644); err != nil {
+		return fmt.Errorf("could not write edge: %w", err)
+	}
+	l.tree, l.edge, l.checkpoint = tree, edge, checkpoint
+	return nil
+}
@@ -0,0 +1,81 @@
+package tlogx_test
+
+import (
+	"crypto/rand"
+	"fmt"
+	"testing"
+
+	"filippo.io/litetlog/internal/tlogx"
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+func TestLog(t *testing.T) {
+	skey, vkey, err := note.GenerateKey(rand.Reader, "example.com/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := note.NewSigner(skey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := note.NewVerifier(vkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	l, err := tlogx.CreateLog(dir, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tlogx.CreateLog(dir, signer); err == nil {
+		t.Error("CreateLog succeeded on an existing log")
+	}
+
+	var size int64
+	for _, batch := range []int64{1, 1, 1, 4, 0, 7, 1, 16, 3, 1} {
+		if size == 7 {
+			// Check that the log can be reopened.
+			l, err = tlogx.OpenLog(dir, signer, verifier)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if l.Tree().N != 7 {
+				t.Fatalf("reopened log has size %d, want 7", l.Tree().N)
+			}
+		}
+		var entries [][]byte
+		for i := range batch {
+			entries = append(entries, []byte(fmt.Sprintf("entry %d\n", size+i)))
+		}
+		index, proofs, err := l.Append(entries...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index != size {
+			t.Errorf("got index %d, want %d", index, size)
+		}
+		if int64(len(proofs)) != batch {
+			t.Fatalf("got %d proofs, want %d", len(proofs), batch)
+		}
+		size += batch
+		n, err := note.Open(l.Checkpoint(), note.VerifierList(verifier))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := tlogx.ParseCheckpoint(n.Text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Tree != l.Tree() || c.N != size {
+			t.Fatalf("checkpoint tree %v doesn't match log tree %v", c.Tree, l.Tree())
+		}
+		for i, entry := range entries {
+			err := tlog.CheckRecord(proofs[i], c.N, c.Hash, index+int64(i), tlog.RecordHash(entry))
+			if err != nil {
+				t.Errorf("entry %d: %v", index+int64(i), err)
+			}
+		}
+	}
+}
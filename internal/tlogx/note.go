@@ -1,11 +1,15 @@
 package tlogx
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"strconv"
 	"strings"
+	"sync"
+	"unicode/utf8"
 
 	"golang.org/x/mod/sumdb/note"
 )
@@ -54,3 +58,94 @@ func chop(s, sep string) (before, after string) {
 	}
 	return s[:i], s[i+len(sep):]
 }
+
+// A NoteBuilder accumulates signatures on a note, for example to aggregate
+// cosignatures from multiple witnesses. It's safe for concurrent use.
+//
+// NoteBuilder only checks that signature lines are well-formed, it doesn't
+// verify them. Callers should only add signatures they verified.
+type NoteBuilder struct {
+	text []byte
+
+	mu   sync.Mutex
+	sigs [][]byte
+	seen map[nameHash]bool
+}
+
+type nameHash struct {
+	name string
+	hash uint32
+}
+
+// NewNoteBuilder returns a NoteBuilder for the signed note n, starting with
+// its existing signatures. The note is split into text and signatures once.
+func NewNoteBuilder(n []byte) (*NoteBuilder, error) {
+	i := bytes.LastIndex(n, []byte("\n\n"))
+	if i < 0 || !utf8.Valid(n) {
+		return nil, errors.New("malformed note")
+	}
+	b := &NoteBuilder{text: n[:i+1], seen: make(map[nameHash]bool)}
+	sigs := n[i+2:]
+	if len(sigs) == 0 || sigs[len(sigs)-1] != '\n' {
+		return nil, errors.New("malformed note")
+	}
+	for _, line := range bytes.SplitAfter(sigs[:len(sigs)-1], []byte("\n")) {
+		if err := b.AddSignature(line); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// AddSignature adds a signature line, in the "— name base64" format, with or
+// without the trailing newline. If a signature from the same key (by name and
+// key hash) was already added, line is ignored, like [note.Open] does.
+func (b *NoteBuilder) AddSignature(line []byte) error {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	name, hash, _, err := parseSignatureLine(string(line))
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.seen[nameHash{name, hash}] {
+		return nil
+	}
+	if len(b.sigs) >= maxSignatures {
+		return errors.New("too many signatures")
+	}
+	b.seen[nameHash{name, hash}] = true
+	b.sigs = append(b.sigs, append(bytes.Clone(line), '\n'))
+	return nil
+}
+
+// Bytes returns the note with all the signatures added so far.
+func (b *NoteBuilder) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := make([]byte, 0, len(b.text)+1+len(b.sigs)*128)
+	n = append(n, b.text...)
+	n = append(n, '\n')
+	for _, sig := range b.sigs {
+		n = append(n, sig...)
+	}
+	return n
+}
+
+// maxSignatures is the maximum number of signatures accepted by [note.Open].
+const maxSignatures = 100
+
+// parseSignatureLine parses a note signature line, without the trailing
+// newline, and returns the key name, the key hash, and the signature.
+func parseSignatureLine(line string) (name string, hash uint32, sig []byte, err error) {
+	line, ok := strings.CutPrefix(line, "— ")
+	if !ok {
+		return "", 0, nil, errors.New("malformed note: invalid signature line")
+	}
+	name, b64 := chop(line, " ")
+	sig, err = base64.StdEncoding.DecodeString(b64)
+	if err != nil || !isValidName(name) || len(sig) < 5 {
+		return "", 0, nil, errors.New("malformed note: invalid signature line")
+	}
+	return name, binary.BigEndian.Uint32(sig), sig[4:], nil
+}
@@ -0,0 +1,89 @@
+package tlogx_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"sync"
+	"testing"
+
+	"filippo.io/litetlog/internal/tlogx"
+	"golang.org/x/mod/sumdb/note"
+)
+
+func TestNoteBuilder(t *testing.T) {
+	skey, vkey, err := note.GenerateKey(rand.Reader, "log.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logSigner, err := note.NewSigner(skey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logVerifier, err := note.NewVerifier(vkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := "log.example\n123\nf+7CoKgXKE/tNys9TTXcr/ad6U/K3xvznmzew9y6SP0=\n"
+	signed, err := note.Sign(&note.Note{Text: msg}, logSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := tlogx.NewNoteBuilder(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifiers := []note.Verifier{logVerifier}
+	var wg sync.WaitGroup
+	for _, name := range []string{"a.example", "b.example", "c.example"} {
+		_, k, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := tlogx.NewCosignatureV1Signer(name, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifiers = append(verifiers, s.Verifier())
+		cosigned, err := note.Sign(&note.Note{Text: msg}, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, line, _ := strings.Cut(string(cosigned), "\n\n")
+		wg.Add(2)
+		for range 2 {
+			// Add each signature twice to check de-duplication.
+			go func() {
+				defer wg.Done()
+				if err := b.AddSignature([]byte(line)); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	n, err := note.Open(b.Bytes(), note.VerifierList(verifiers...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Text != msg {
+		t.Errorf("got text %q, want %q", n.Text, msg)
+	}
+	if len(n.Sigs) != 4 {
+		t.Errorf("got %d signatures, want 4", len(n.Sigs))
+	}
+	if got := strings.Count(string(b.Bytes()), "\n— "); got != 4 {
+		t.Errorf("got %d signature lines, want 4", got)
+	}
+
+	for _, line := range []string{
+		"", "log.example AAAAAA==", "— log.example", "— log.example !!!",
+		"— log.example AAAA", "— bad name AAAAAAAA",
+	} {
+		if err := b.AddSignature([]byte(line)); err == nil {
+			t.Errorf("AddSignature(%q) succeeded", line)
+		}
+	}
+}
@@ -5,23 +5,107 @@
 
 package tlogx
 
-import "golang.org/x/mod/sumdb/tlog"
+import (
+	"fmt"
+	"math/bits"
+	"slices"
+
+	"golang.org/x/mod/sumdb/tlog"
+)
 
 // RightEdge returns the stored hash indexes of the right edge of a tree of
 // size n. These are the same hashes that are combined into a [tlog.TreeHash]
 // and allow producing record and tree proofs for any size bigger than n. See
 // [tlog.StoredHashIndex] for the definition of stored hash indexes.
 func RightEdge(n int64) []int64 {
-	var lo int64
-	var idx []int64
-	for lo < n {
-		k, level := maxpow2(n - lo + 1)
+	return subTreeIndex(0, n, nil)
+}
+
+// subTreeIndex appends to idx the stored hash indexes of the perfect subtrees
+// that make up the leaves [lo, hi), where lo is a multiple of the size of the
+// largest of them.
+func subTreeIndex(lo, hi int64, idx []int64) []int64 {
+	for lo < hi {
+		k, level := maxpow2(hi - lo + 1)
 		idx = append(idx, tlog.StoredHashIndex(level, lo>>level))
 		lo += k
 	}
 	return idx
 }
 
+// ProofTiles returns the tiles of height 8 that contain the stored hashes read
+// by [tlog.ProveRecord] to prove the record at index in a tree of size treeN.
+// The tiles are as wide as they can be in a tree of size treeN, so tiles at the
+// right edge of the tree are partial.
+//
+// If index is not in the tree, ProofTiles returns nil.
+func ProofTiles(treeN, index int64) []tlog.Tile {
+	if index < 0 || index >= treeN {
+		return nil
+	}
+	const h = 8
+	var tiles []tlog.Tile
+	for _, x := range recordProofIndex(0, treeN, index, nil) {
+		t := tlog.TileForIndex(h, x)
+		t.W = int(min(1<<h, treeN>>(t.L*h)-t.N<<h))
+		if !slices.Contains(tiles, t) {
+			tiles = append(tiles, t)
+		}
+	}
+	return tiles
+}
+
+// recordProofIndex appends to idx the stored hash indexes needed to prove the
+// leaf n in the subtree [lo, hi), in the same order as [tlog.ProveRecord].
+func recordProofIndex(lo, hi, n int64, idx []int64) []int64 {
+	if lo+1 == hi {
+		return idx
+	}
+	k, _ := maxpow2(hi - lo)
+	if n < lo+k {
+		idx = recordProofIndex(lo, lo+k, n, idx)
+		return subTreeIndex(lo+k, hi, idx)
+	}
+	idx = subTreeIndex(lo, lo+k, idx)
+	return recordProofIndex(lo+k, hi, n, idx)
+}
+
+// AppendToEdge appends leaves to a tree of size n, given the hashes of its
+// right edge, in the order of the indexes returned by [RightEdge]. It returns
+// the new tree size, right edge hashes, and tree hash.
+//
+// The record proof for the first new leaf in the tree of size n+1 is the old
+// edge in reverse order.
+func AppendToEdge(n int64, edge []tlog.Hash, leaves [][]byte) (newN int64, newEdge []tlog.Hash, newRoot tlog.Hash, err error) {
+	if n < 0 {
+		return 0, nil, tlog.Hash{}, fmt.Errorf("invalid tree size %d", n)
+	}
+	if len(edge) != bits.OnesCount64(uint64(n)) {
+		return 0, nil, tlog.Hash{}, fmt.Errorf("got %d edge hashes for tree size %d, want %d",
+			len(edge), n, bits.OnesCount64(uint64(n)))
+	}
+	newEdge = append([]tlog.Hash(nil), edge...)
+	newN = n
+	for _, leaf := range leaves {
+		// Like a binary counter increment: the new leaf is merged with the
+		// trailing perfect subtrees, one per trailing one bit of newN.
+		h := tlog.RecordHash(leaf)
+		for k := bits.TrailingZeros64(^uint64(newN)); k > 0; k-- {
+			h = tlog.NodeHash(newEdge[len(newEdge)-1], h)
+			newEdge = newEdge[:len(newEdge)-1]
+		}
+		newEdge = append(newEdge, h)
+		newN++
+	}
+	if len(newEdge) > 0 {
+		newRoot = newEdge[len(newEdge)-1]
+		for i := len(newEdge) - 2; i >= 0; i-- {
+			newRoot = tlog.NodeHash(newEdge[i], newRoot)
+		}
+	}
+	return newN, newEdge, newRoot, nil
+}
+
 // maxpow2 returns k, the maximum power of 2 smaller than n,
 // as well as l = log₂ k (so k = 1<<l).
 func maxpow2(n int64) (k int64, l int) {
@@ -2,6 +2,7 @@ package tlogx_test
 
 import (
 	"reflect"
+	"slices"
 	"testing"
 
 	"filippo.io/litetlog/internal/tlogx"
@@ -29,3 +30,115 @@ func TestRightEdge(t *testing.T) {
 		}
 	}
 }
+
+func TestProofTiles(t *testing.T) {
+	for _, treeN := range []int64{1, 2, 13, 256, 257, 1000, 65536, 70000, 16777217} {
+		for _, index := range []int64{0, 1, 255, 256, 300, 65535, 65536, treeN / 2, treeN - 1} {
+			if index >= treeN {
+				continue
+			}
+			// Record the indexes tlog.ProveRecord actually reads.
+			var read []int64
+			hr := tlog.HashReaderFunc(func(indexes []int64) ([]tlog.Hash, error) {
+				read = append(read, indexes...)
+				return make([]tlog.Hash, len(indexes)), nil
+			})
+			if _, err := tlog.ProveRecord(treeN, index, hr); err != nil {
+				t.Fatal(err)
+			}
+
+			tiles := tlogx.ProofTiles(treeN, index)
+			used := make(map[tlog.Tile]bool)
+			for _, x := range read {
+				found := false
+				for _, tile := range tiles {
+					if _, err := tlog.HashFromTile(tile, make([]byte, tile.W*tlog.HashSize), x); err == nil {
+						used[tile] = true
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("ProofTiles(%d, %d): no tile contains index %d", treeN, index, x)
+				}
+			}
+			for _, tile := range tiles {
+				if !used[tile] {
+					t.Errorf("ProofTiles(%d, %d): tile %s is not needed", treeN, index, tile.Path())
+				}
+				if maxW := treeN>>(tile.L*tile.H) - tile.N<<tile.H; int64(tile.W) > maxW {
+					t.Errorf("ProofTiles(%d, %d): tile %s is past the end of the tree", treeN, index, tile.Path())
+				}
+			}
+		}
+	}
+	if tiles := tlogx.ProofTiles(10, 10); tiles != nil {
+		t.Errorf("ProofTiles(10, 10) = %v; want nil", tiles)
+	}
+}
+
+func TestAppendToEdge(t *testing.T) {
+	var hashes []tlog.Hash
+	hr := tlog.HashReaderFunc(func(indexes []int64) ([]tlog.Hash, error) {
+		list := make([]tlog.Hash, 0, len(indexes))
+		for _, id := range indexes {
+			list = append(list, hashes[id])
+		}
+		return list, nil
+	})
+
+	var n int64
+	var edge []tlog.Hash
+	for _, batch := range []int{0, 1, 1, 2, 3, 5, 8, 13, 1, 0, 21, 34} {
+		// Check the proof for the first leaf before appending the batch.
+		proof := make([]tlog.Hash, len(edge))
+		for i, h := range edge {
+			proof[len(edge)-1-i] = h
+		}
+
+		var leaves [][]byte
+		for i := range batch {
+			leaf := []byte{byte(n + int64(i))}
+			leaves = append(leaves, leaf)
+			h, err := tlog.StoredHashes(n+int64(i), leaf, hr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hashes = append(hashes, h...)
+		}
+		newN, newEdge, newRoot, err := tlogx.AppendToEdge(n, edge, leaves)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if newN != n+int64(batch) {
+			t.Fatalf("got size %d, want %d", newN, n+int64(batch))
+		}
+		th, err := tlog.TreeHash(newN, hr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if newRoot != th {
+			t.Errorf("size %d: got root %v, want %v", newN, newRoot, th)
+		}
+		wantEdge, err := hr.ReadHashes(tlogx.RightEdge(newN))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(newEdge, wantEdge) {
+			t.Errorf("size %d: got edge %v, want %v", newN, newEdge, wantEdge)
+		}
+		if batch > 0 {
+			want, err := tlog.ProveRecord(n+1, n, hr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(proof, want) {
+				t.Errorf("size %d: got proof %v, want %v", n+1, proof, want)
+			}
+		}
+		n, edge = newN, newEdge
+	}
+
+	if _, _, _, err := tlogx.AppendToEdge(3, edge[:1], nil); err == nil {
+		t.Error("AppendToEdge with wrong edge length succeeded")
+	}
+}
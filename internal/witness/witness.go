@@ -2,14 +2,20 @@ package witness
 
 import (
 	"bytes"
+	"cmp"
+	"context"
 	"crypto"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
@@ -19,24 +25,85 @@ import (
 )
 
 type Witness struct {
-	db  *sqlite.Conn
 	s   *tlogx.CosignatureV1Signer
 	mux *http.ServeMux
 	log *slog.Logger
 
+	// dbMu serializes the use of db, as a sqlite.Conn is not safe for
+	// concurrent use, while requests are served concurrently.
+	dbMu sync.Mutex
+	db   *sqlite.Conn
+
+	countsMu sync.Mutex
+	counts   map[requestCountKey]int64
+
+	// keys caches the parsed verifiers of each log. It's invalidated when the
+	// database is modified by another connection, such as by witnessctl, as
+	// reported by PRAGMA data_version.
+	keysMu      sync.Mutex
+	keys        map[string]note.Verifiers
+	keysVersion int64
+
+	// learn are the verifiers from Policy.LearnKeys, by origin.
+	learn map[string]*learnKeys
+
 	// testingOnlyStallRequest is called after checking a valid tree head, but
 	// before committing it to the database. It's used in tests to cause a race
 	// between two requests and simulating the risk of a rollback.
 	testingOnlyStallRequest func()
 }
 
-func OpenDB(dbPath string) (*sqlite.Conn, error) {
-	db, err := sqlite.OpenConn(dbPath, 0)
+// OpenDB opens the witness database at dbPath, creating it and upgrading its
+// schema if necessary. If the database is locked by another connection, it
+// retries until ctx is done.
+//
+// The database is in WAL mode, so that readers don't block the writer and
+// vice versa. A [Witness] holds a single connection for its lifetime, and
+// serializes its use. Other connections, such as those opened by witnessctl
+// or by the litewitness index page, can be opened concurrently, and must be
+// short-lived. Conflicting writes wait for each other for up to busyTimeout,
+// after which they fail with SQLITE_BUSY.
+//
+// The returned connection is not safe for concurrent use.
+func OpenDB(ctx context.Context, dbPath string) (*sqlite.Conn, error) {
+	for delay := 10 * time.Millisecond; ; delay = min(2*delay, time.Second) {
+		db, err := openDB(ctx, dbPath)
+		if err == nil {
+			return db, nil
+		}
+		if code := sqlite.ErrCode(err) & 0xff; code != sqlite.SQLITE_BUSY && code != sqlite.SQLITE_LOCKED {
+			return nil, err
+		}
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, fmt.Errorf("%w: %v", ctx.Err(), err)
+		case <-t.C:
+		}
+	}
+}
+
+// busyTimeout is how long a statement waits for a conflicting connection to
+// release its lock before failing with SQLITE_BUSY.
+const busyTimeout = 5 * time.Second
+
+func openDB(ctx context.Context, dbPath string) (db *sqlite.Conn, err error) {
+	db, err = sqlite.OpenConn(dbPath, sqlite.SQLITE_OPEN_READWRITE|sqlite.SQLITE_OPEN_CREATE|
+		sqlite.SQLITE_OPEN_WAL|sqlite.SQLITE_OPEN_URI|sqlite.SQLITE_OPEN_NOMUTEX)
 	if err != nil {
-		return nil, fmt.Errorf("opening database: %v", err)
+		return nil, fmt.Errorf("opening database: %w", err)
 	}
+	defer func() {
+		if err != nil {
+			db.Close()
+		}
+	}()
+	db.SetBusyTimeout(busyTimeout)
+	db.SetInterrupt(ctx.Done())
+	defer db.SetInterrupt(nil)
 
-	return db, sqlitex.ExecScript(db, `
+	if err := sqlitex.ExecScript(db, `
 		PRAGMA strict_types = ON;
 		PRAGMA foreign_keys = ON;
 		CREATE TABLE IF NOT EXISTS log (
@@ -49,11 +116,83 @@ func OpenDB(dbPath string) (*sqlite.Conn, error) {
 			key TEXT NOT NULL, -- note verifier key
 			FOREIGN KEY(origin) REFERENCES log(origin)
 		);
-	`)
+	`); err != nil {
+		return nil, err
+	}
+
+	// If set, the first tree head for the log must match these exactly.
+	if err := addColumn(db, "log", "pinned_size", "INTEGER"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "log", "pinned_hash", "TEXT"); err != nil { // base64-encoded
+		return nil, err
+	}
+	// The latest checkpoint note cosigned by the witness, for accountability.
+	if err := addColumn(db, "log", "checkpoint", "TEXT"); err != nil {
+		return nil, err
+	}
+	// The Unix time in seconds of the last tree head update, or NULL.
+	if err := addColumn(db, "log", "last_updated", "INTEGER"); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// addColumn adds a column to an existing table, if it's not present already.
+func addColumn(db *sqlite.Conn, table, column, typ string) error {
+	found := false
+	if err := sqlitex.Exec(db, "SELECT name FROM pragma_table_info(?)",
+		func(stmt *sqlite.Stmt) error {
+			if stmt.ColumnText(0) == column {
+				found = true
+			}
+			return nil
+		}, table); err != nil {
+		return err
+	}
+	if found {
+		return nil
+	}
+	return sqlitex.ExecScript(db, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", table, column, typ))
+}
+
+// A Policy controls which logs a Witness cosigns checkpoints for.
+//
+// The zero value is the strict policy: only logs added to the database, for
+// example with witnessctl, are cosigned, and checkpoints for any other origin
+// are rejected as coming from an unknown log.
+type Policy struct {
+	// LearnKeys are verifier keys of logs to learn on first use. The first
+	// time a checkpoint for an origin that's not in the database is validly
+	// signed by a key in LearnKeys with the same name as the origin, the log is
+	// added to the database with the matching keys, and its tree head is
+	// trusted. From then on, the log is treated like any other, and removing
+	// its keys from LearnKeys has no effect.
+	LearnKeys []string
+}
+
+type learnKeys struct {
+	vkeys     []string
+	verifiers []note.Verifier
 }
 
-func NewWitness(dbPath, name string, key crypto.Signer, log *slog.Logger) (*Witness, error) {
-	db, err := OpenDB(dbPath)
+func NewWitness(dbPath, name string, key crypto.Signer, policy Policy, log *slog.Logger) (*Witness, error) {
+	learn := make(map[string]*learnKeys)
+	for _, k := range policy.LearnKeys {
+		v, err := note.NewVerifier(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid learn key %q: %v", k, err)
+		}
+		if learn[v.Name()] == nil {
+			learn[v.Name()] = &learnKeys{}
+		}
+		learn[v.Name()].vkeys = append(learn[v.Name()].vkeys, k)
+		learn[v.Name()].verifiers = append(learn[v.Name()].verifiers, v)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	db, err := OpenDB(ctx, dbPath)
 	if err != nil {
 		return nil, fmt.Errorf("initializing database: %v", err)
 	}
@@ -68,12 +207,18 @@ func NewWitness(dbPath, name string, key crypto.Signer, log *slog.Logger) (*Witn
 		s:   s,
 		log: log,
 		mux: http.NewServeMux(),
+
+		counts: make(map[requestCountKey]int64),
+		keys:   make(map[string]note.Verifiers),
+		learn:  learn,
 	}
 	w.mux.Handle("POST /add-checkpoint", http.HandlerFunc(w.serveAddCheckpoint))
 	return w, nil
 }
 
 func (w *Witness) Close() error {
+	w.dbMu.Lock()
+	defer w.dbMu.Unlock()
 	return w.db.Close()
 }
 
@@ -85,6 +230,60 @@ func (w *Witness) VerifierKey() string {
 	return w.s.VerifierKey()
 }
 
+// RequestCount is the number of add-checkpoint requests with a given outcome.
+type RequestCount struct {
+	// Origin is the log origin, or empty if the request didn't match a known
+	// log, so that the number of distinct values is bounded.
+	Origin string
+
+	// Outcome is one of "success", "conflict", "unknown_log",
+	// "invalid_signature", "bad_proof", "bad_request", or "error".
+	Outcome string
+
+	Count int64
+}
+
+type requestCountKey struct {
+	origin, outcome string
+}
+
+// RequestCounts returns the number of add-checkpoint requests processed since
+// the Witness was created, by origin and outcome, sorted.
+func (w *Witness) RequestCounts() []RequestCount {
+	w.countsMu.Lock()
+	defer w.countsMu.Unlock()
+	var counts []RequestCount
+	for k, n := range w.counts {
+		counts = append(counts, RequestCount{Origin: k.origin, Outcome: k.outcome, Count: n})
+	}
+	slices.SortFunc(counts, func(a, b RequestCount) int {
+		return cmp.Or(cmp.Compare(a.Origin, b.Origin), cmp.Compare(a.Outcome, b.Outcome))
+	})
+	return counts
+}
+
+func (w *Witness) countRequest(origin string, err error) {
+	outcome := "error"
+	switch err {
+	case nil:
+		outcome = "success"
+	case errUnknownLog:
+		outcome = "unknown_log"
+	case errInvalidSignature:
+		outcome = "invalid_signature"
+	case errProof:
+		outcome = "bad_proof"
+	case errBadRequest:
+		outcome = "bad_request"
+	}
+	if _, ok := err.(*conflictError); ok {
+		outcome = "conflict"
+	}
+	w.countsMu.Lock()
+	defer w.countsMu.Unlock()
+	w.counts[requestCountKey{origin, outcome}]++
+}
+
 type conflictError struct {
 	known int64
 }
@@ -97,42 +296,95 @@ var errBadRequest = errors.New("invalid input")
 var errProof = errors.New("bad consistency proof")
 
 func (w *Witness) serveAddCheckpoint(rw http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	code := http.StatusOK
+	var origin string
+	defer func() {
+		attrs := []any{"method", r.Method, "remote", r.RemoteAddr}
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			attrs = append(attrs, "forwarded_for", xff)
+		}
+		attrs = append(attrs, "origin", origin, "code", code, "latency", time.Since(start))
+		w.log.InfoContext(r.Context(), "add-checkpoint", attrs...)
+	}()
+
 	body, err := io.ReadAll(r.Body)
+	if maxErr := (*http.MaxBytesError)(nil); errors.As(err, &maxErr) {
+		w.log.DebugContext(r.Context(), "request body too large", "limit", maxErr.Limit)
+		code = http.StatusRequestEntityTooLarge
+		http.Error(rw, fmt.Sprintf("request body larger than %d bytes", maxErr.Limit), code)
+		return
+	}
 	if err != nil {
 		w.log.DebugContext(r.Context(), "error reading request body", "error", err)
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		code = http.StatusInternalServerError
+		http.Error(rw, err.Error(), code)
 		return
 	}
-	cosig, err := w.processAddCheckpointRequest(body)
+	// The origin is only extracted for logging, processAddCheckpointRequest
+	// does the actual parsing.
+	if _, n, ok := bytes.Cut(body, []byte("\n\n")); ok {
+		o, _, _ := bytes.Cut(n, []byte("\n"))
+		origin = string(o)
+	}
+	signed, cosig, err := w.processAddCheckpointRequest(body)
 	if err, ok := err.(*conflictError); ok {
+		code = http.StatusConflict
 		rw.Header().Set("Content-Type", "text/x.tlog.size")
-		rw.WriteHeader(http.StatusConflict)
+		rw.WriteHeader(code)
 		fmt.Fprintf(rw, "%d\n", err.known)
 		return
 	}
+	// Status codes follow c2sp.org/tlog-witness.
 	switch err {
-	case errUnknownLog, errInvalidSignature:
-		http.Error(rw, err.Error(), http.StatusForbidden)
-		return
+	case nil:
+	case errUnknownLog:
+		code = http.StatusNotFound
+	case errInvalidSignature:
+		code = http.StatusForbidden
 	case errBadRequest:
-		http.Error(rw, err.Error(), http.StatusBadRequest)
-		return
+		code = http.StatusBadRequest
 	case errProof:
-		http.Error(rw, err.Error(), http.StatusUnprocessableEntity)
-		return
+		code = http.StatusUnprocessableEntity
+	default:
+		code = http.StatusInternalServerError
 	}
 	if err != nil {
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		http.Error(rw, err.Error(), code)
 		return
 	}
-	if _, err := rw.Write(cosig); err != nil {
+	resp := cosig
+	if acceptsNote(r) {
+		rw.Header().Set("Content-Type", "text/x.tlog.note")
+		resp = signed
+	}
+	if _, err := rw.Write(resp); err != nil {
 		w.log.DebugContext(r.Context(), "error writing response", "error", err)
 	}
 }
 
-func (w *Witness) processAddCheckpointRequest(body []byte) (cosig []byte, err error) {
+// acceptsNote returns whether the client asked for the full cosigned note
+// with an Accept: text/x.tlog.note header, rather than just the cosignature
+// lines specified by the Sigsum witness protocol.
+func acceptsNote(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept") {
+		for _, t := range strings.Split(v, ",") {
+			t, _, _ = strings.Cut(t, ";")
+			if strings.TrimSpace(t) == "text/x.tlog.note" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// processAddCheckpointRequest returns the note cosigned by the witness, which
+// includes the verified log signatures, and the witness cosignature line alone.
+func (w *Witness) processAddCheckpointRequest(body []byte) (signed, cosig []byte, err error) {
 	l := w.log.With("request", string(body))
+	var knownOrigin string
 	defer func() {
+		w.countRequest(knownOrigin, err)
 		if err != nil {
 			l = l.With("error", err)
 		}
@@ -140,65 +392,83 @@ func (w *Witness) processAddCheckpointRequest(body []byte) (cosig []byte, err er
 	}()
 	body, noteBytes, ok := bytes.Cut(body, []byte("\n\n"))
 	if !ok {
-		return nil, errBadRequest
+		return nil, nil, errBadRequest
 	}
 	lines := strings.Split(string(body), "\n")
 	if len(lines) < 1 {
-		return nil, errBadRequest
+		return nil, nil, errBadRequest
 	}
 	size, ok := strings.CutPrefix(lines[0], "old ")
 	if !ok {
-		return nil, errBadRequest
+		return nil, nil, errBadRequest
 	}
 	oldSize, err := strconv.ParseInt(size, 10, 64)
 	if err != nil || oldSize < 0 {
-		return nil, errBadRequest
+		return nil, nil, errBadRequest
 	}
 	l = l.With("oldSize", oldSize)
 	proof := make(tlog.TreeProof, len(lines[1:]))
 	for i, h := range lines[1:] {
 		proof[i], err = tlog.ParseHash(h)
 		if err != nil {
-			return nil, errBadRequest
+			return nil, nil, errBadRequest
 		}
 	}
 	origin, _, _ := strings.Cut(string(noteBytes), "\n")
 	l = l.With("origin", origin)
 	verifier, err := w.getKeys(origin)
-	if err != nil {
-		return nil, err
-	}
+	var learn *learnKeys
+	if err == errUnknownLog && w.learn[origin] != nil {
+		learn = w.learn[origin]
+		verifier = note.VerifierList(learn.verifiers...)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	// The learnable origins are bounded by the Policy, like the known ones.
+	knownOrigin = origin
 	n, err := note.Open(noteBytes, verifier)
 	switch err.(type) {
 	case *note.UnverifiedNoteError, *note.InvalidSignatureError:
-		return nil, errInvalidSignature
+		return nil, nil, errInvalidSignature
 	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	c, err := tlogx.ParseCheckpoint(n.Text)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if learn != nil {
+		// Only add the log once the checkpoint is validly signed and well
+		// formed, so that bad requests can't modify the database.
+		if err := w.learnLog(origin, learn.vkeys); err != nil {
+			return nil, nil, err
+		}
+		w.log.Info("learned new log on first use", "origin", origin)
 	}
 	l = l.With("size", c.N)
 	if err := w.checkConsistency(c.Origin, oldSize, c.N, c.Hash, proof); err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	// Sign before persisting, so that the stored note is exactly the one
+	// returned to the client.
+	signed, err = note.Sign(&note.Note{Text: n.Text, Sigs: n.Sigs}, w.s)
+	if err != nil {
+		return nil, nil, err
 	}
 	if w.testingOnlyStallRequest != nil {
 		w.testingOnlyStallRequest()
 	}
-	if err := w.persistTreeHead(c.Origin, oldSize, c.N, c.Hash); err != nil {
-		return nil, err
-	}
-	signed, err := note.Sign(&note.Note{Text: n.Text}, w.s)
-	if err != nil {
-		return nil, err
+	if err := w.persistTreeHead(c.Origin, oldSize, c.N, c.Hash, signed); err != nil {
+		return nil, nil, err
 	}
 	sigs, err := splitSignatures(signed)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return sigs, err
+	// note.Sign adds the new signature after the existing ones.
+	cosig = sigs[bytes.LastIndexByte(sigs[:len(sigs)-1], '\n')+1:]
+	return signed, cosig, nil
 }
 
 func splitSignatures(note []byte) ([]byte, error) {
@@ -227,7 +497,15 @@ func (w *Witness) checkConsistency(origin string,
 		return &conflictError{knownSize}
 	}
 	if oldSize == 0 {
-		// This is the first tree head for this log.
+		// This is the first tree head for this log. If the log was added with
+		// a pinned tree head, there's nothing to check it against but the pin.
+		pinned, pinnedSize, pinnedHash, err := w.getPin(origin)
+		if err != nil {
+			return err
+		}
+		if pinned && (newSize != pinnedSize || newHash != pinnedHash) {
+			return errProof
+		}
 		return nil
 	}
 	if err := tlog.CheckTree(proof, newSize, newHash, oldSize, oldHash); err != nil {
@@ -236,16 +514,19 @@ func (w *Witness) checkConsistency(origin string,
 	return nil
 }
 
-func (w *Witness) persistTreeHead(origin string, oldSize, newSize int64, newHash tlog.Hash) error {
+func (w *Witness) persistTreeHead(origin string, oldSize, newSize int64, newHash tlog.Hash, checkpoint []byte) error {
 	// Check oldSize against the database to prevent rolling back on a race.
 	// Alternatively, we could use a database transaction which would be cleaner
 	// but would encode a critical security semantic in the implicit use of the
 	// correct Conn across functions, which is uncomfortable.
-	err := w.dbExec(`
-			UPDATE log SET tree_size = ?, tree_hash = ?
+	w.dbMu.Lock()
+	err := w.dbExecLocked(`
+			UPDATE log SET tree_size = ?, tree_hash = ?, checkpoint = ?, last_updated = ?
 			WHERE origin = ? AND tree_size = ?`,
-		nil, newSize, newHash, origin, oldSize)
-	if err == nil && w.db.Changes() != 1 {
+		nil, newSize, newHash, string(checkpoint), time.Now().Unix(), origin, oldSize)
+	changes := w.db.Changes()
+	w.dbMu.Unlock()
+	if err == nil && changes != 1 {
 		knownSize, _, err := w.getLog(origin)
 		if err != nil {
 			return err
@@ -255,6 +536,30 @@ func (w *Witness) persistTreeHead(origin string, oldSize, newSize int64, newHash
 	return err
 }
 
+// learnLog adds a log with the given keys and an empty tree to the database.
+// If the log was added concurrently, for example by witnessctl without keys,
+// it returns errUnknownLog, to avoid trusting keys that weren't configured
+// for it.
+func (w *Witness) learnLog(origin string, vkeys []string) (err error) {
+	w.dbMu.Lock()
+	defer w.dbMu.Unlock()
+	defer sqlitex.Save(w.db)(&err)
+	emptyHash := tlog.Hash(sha256.Sum256(nil))
+	if err := w.dbExecLocked("INSERT OR IGNORE INTO log (origin, tree_size, tree_hash) VALUES (?, 0, ?)",
+		nil, origin, emptyHash.String()); err != nil {
+		return err
+	}
+	if w.db.Changes() != 1 {
+		return errUnknownLog
+	}
+	for _, k := range vkeys {
+		if err := w.dbExecLocked("INSERT INTO key (origin, key) VALUES (?, ?)", nil, origin, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (w *Witness) getLog(origin string) (treeSize int64, treeHash tlog.Hash, err error) {
 	found := false
 	err = w.dbExec("SELECT tree_size, tree_hash FROM log WHERE origin = ?",
@@ -270,7 +575,51 @@ func (w *Witness) getLog(origin string) (treeSize int64, treeHash tlog.Hash, err
 	return
 }
 
+func (w *Witness) getPin(origin string) (pinned bool, treeSize int64, treeHash tlog.Hash, err error) {
+	err = w.dbExec("SELECT pinned_size, pinned_hash FROM log WHERE origin = ? AND pinned_size IS NOT NULL",
+		func(stmt *sqlite.Stmt) error {
+			pinned = true
+			treeSize = stmt.GetInt64("pinned_size")
+			treeHash, err = tlog.ParseHash(stmt.GetText("pinned_hash"))
+			return err
+		}, origin)
+	return
+}
+
 func (w *Witness) getKeys(origin string) (note.Verifiers, error) {
+	var version int64
+	if err := w.dbExec("PRAGMA data_version", func(stmt *sqlite.Stmt) error {
+		version = stmt.ColumnInt64(0)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	w.keysMu.Lock()
+	if version != w.keysVersion {
+		clear(w.keys)
+		w.keysVersion = version
+	}
+	cached, ok := w.keys[origin]
+	w.keysMu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	verifiers, err := w.loadKeys(origin)
+	if err != nil {
+		return nil, err
+	}
+	w.keysMu.Lock()
+	if version == w.keysVersion {
+		w.keys[origin] = verifiers
+	}
+	w.keysMu.Unlock()
+	return verifiers, nil
+}
+
+// loadKeys reads and parses the keys of a log from the database. Only
+// successfully parsed sets of keys are cached by getKeys.
+func (w *Witness) loadKeys(origin string) (note.Verifiers, error) {
 	var keys []string
 	err := w.dbExec("SELECT key FROM key WHERE origin = ?",
 		func(stmt *sqlite.Stmt) error {
@@ -296,6 +645,14 @@ func (w *Witness) getKeys(origin string) (note.Verifiers, error) {
 }
 
 func (w *Witness) dbExec(query string, resultFn func(stmt *sqlite.Stmt) error, args ...interface{}) error {
+	w.dbMu.Lock()
+	defer w.dbMu.Unlock()
+	return w.dbExecLocked(query, resultFn, args...)
+}
+
+// dbExecLocked is like dbExec, but dbMu must be held, so that multiple
+// statements can be executed without interleaving with other requests.
+func (w *Witness) dbExecLocked(query string, resultFn func(stmt *sqlite.Stmt) error, args ...interface{}) error {
 	err := sqlitex.Exec(w.db, query, resultFn, args...)
 	if err != nil {
 		w.log.Error("database error", "error", err)
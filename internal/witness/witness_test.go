@@ -1,15 +1,23 @@
 package witness
 
 import (
+	"bytes"
+	"context"
 	"crypto/ed25519"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
 	"golang.org/x/mod/sumdb/note"
 	"golang.org/x/mod/sumdb/tlog"
@@ -21,7 +29,7 @@ func TestRace(t *testing.T) {
 	ss := ed25519.PrivateKey(mustDecodeHex(t,
 		"31ffc2116ecbe003acaa800ab70757bd7d53206e3febef6a6d0796d95530b34f"+
 			"64848ad8abed6e85981b3b3875b252b8767ebb4b02f703aca3b1e71bbd6a8e50"))
-	w, err := NewWitness(":memory:", "example.com", ss, slog.New(testLogHandler(t)))
+	w, err := NewWitness(":memory:", "example.com", ss, Policy{}, slog.New(testLogHandler(t)))
 	fatalIfErr(t, err)
 	t.Cleanup(func() { w.Close() })
 	pk := mustDecodeHex(t, "ffdc2d4d98e4124d3feaf788c0c2f9abfd796083d1f0495437f302ec79cf100f")
@@ -34,7 +42,7 @@ func TestRace(t *testing.T) {
 	fatalIfErr(t, err)
 	fatalIfErr(t, sqlitex.Exec(w.db, "INSERT INTO key (origin, key) VALUES (?, ?)", nil, origin, k))
 
-	_, err = w.processAddCheckpointRequest([]byte(`old 0
+	signed, cosig, err := w.processAddCheckpointRequest([]byte(`old 0
 
 sigsum.org/v1/tree/4d6d8825a6bb689d459628312889dfbb0bcd41b5211d9e1ce768b0ff0309e562
 1
@@ -43,6 +51,17 @@ KgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
 — sigsum.org/v1/tree/4d6d8825a6bb689d459628312889dfbb0bcd41b5211d9e1ce768b0ff0309e562 UgIom7fPZTqpxWWhyjWduBvTvGVqsokMbqTArsQilegKoFBJQjUFAmQ0+YeSPM3wfUQMFSzVnnNuWRTYrajXpNUbIQY=
 `))
 	fatalIfErr(t, err)
+	if !bytes.HasSuffix(signed, cosig) || bytes.Count(cosig, []byte("\n")) != 1 {
+		t.Errorf("cosignature %q is not the last line of the note %q", cosig, signed)
+	}
+	kv, err := note.NewVerifier(k)
+	fatalIfErr(t, err)
+	n, err := note.Open(signed, note.VerifierList(kv))
+	fatalIfErr(t, err)
+	if len(n.Sigs) != 1 || len(n.UnverifiedSigs) != 1 {
+		t.Errorf("got %d log signatures and %d other signatures, want 1 and 1",
+			len(n.Sigs), len(n.UnverifiedSigs))
+	}
 
 	// Stall the first request updating to the shorter size between getting
 	// consistency checked and being committed to the database.
@@ -55,7 +74,7 @@ KgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
 		secondHalf.Lock()
 	}
 	go func() {
-		cosig, err := w.processAddCheckpointRequest([]byte(`old 1
+		_, cosig, err := w.processAddCheckpointRequest([]byte(`old 1
 KgEAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
 KgIAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
 
@@ -78,7 +97,7 @@ RcCI1Nk56ZcSmIEfIn0SleqtV7uvrlXNccFx595Iwl0=
 	firstHalf.Lock()
 
 	w.testingOnlyStallRequest = nil
-	_, err = w.processAddCheckpointRequest([]byte(`old 1
+	signed, _, err = w.processAddCheckpointRequest([]byte(`old 1
 KgEAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
 +fUDV+k970B4I3uKrqJM4aP1lloPZP8mvr2Z4wRw2LI=
 KgQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
@@ -107,6 +126,291 @@ QrtXrQZCCvpIgsSmOsah7HdICzMLLyDfxToMql9WTjY=
 	if hash != mustDecodeHash(t, "42bb57ad06420afa4882c4a63ac6a1ec77480b330b2f20dfc53a0caa5f564e36") {
 		t.Error("unexpected tree hash")
 	}
+	var stored string
+	var lastUpdated int64
+	fatalIfErr(t, sqlitex.Exec(w.db, "SELECT checkpoint, last_updated FROM log WHERE origin = ?",
+		func(stmt *sqlite.Stmt) error {
+			stored = stmt.ColumnText(0)
+			lastUpdated = stmt.ColumnInt64(1)
+			return nil
+		}, origin))
+	if stored != string(signed) {
+		t.Errorf("stored checkpoint %q, want %q", stored, signed)
+	}
+	if since := time.Since(time.Unix(lastUpdated, 0)); since < 0 || since > time.Minute {
+		t.Errorf("last_updated is %d, not recent", lastUpdated)
+	}
+
+	counts := w.RequestCounts()
+	expected := []RequestCount{
+		{Origin: origin, Outcome: "conflict", Count: 1},
+		{Origin: origin, Outcome: "success", Count: 2},
+	}
+	if !slices.Equal(counts, expected) {
+		t.Errorf("got request counts %v, want %v", counts, expected)
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	ss := ed25519.PrivateKey(mustDecodeHex(t,
+		"31ffc2116ecbe003acaa800ab70757bd7d53206e3febef6a6d0796d95530b34f"+
+			"64848ad8abed6e85981b3b3875b252b8767ebb4b02f703aca3b1e71bbd6a8e50"))
+	w, err := NewWitness(":memory:", "example.com", ss, Policy{}, slog.New(testLogHandler(t)))
+	fatalIfErr(t, err)
+	t.Cleanup(func() { w.Close() })
+	pk := mustDecodeHex(t, "ffdc2d4d98e4124d3feaf788c0c2f9abfd796083d1f0495437f302ec79cf100f")
+	origin := "sigsum.org/v1/tree/4d6d8825a6bb689d459628312889dfbb0bcd41b5211d9e1ce768b0ff0309e562"
+
+	treeHash := merkle.HashEmptyTree()
+	fatalIfErr(t, sqlitex.Exec(w.db, "INSERT INTO log (origin, tree_size, tree_hash) VALUES (?, 0, ?)",
+		nil, origin, base64.StdEncoding.EncodeToString(treeHash[:])))
+	k, err := note.NewEd25519VerifierKey(origin, pk[:])
+	fatalIfErr(t, err)
+	fatalIfErr(t, sqlitex.Exec(w.db, "INSERT INTO key (origin, key) VALUES (?, ?)", nil, origin, k))
+
+	// The requests share the Witness database connection, which must not be
+	// used concurrently. Run with -race to check.
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := w.processAddCheckpointRequest([]byte(`old 0
+
+sigsum.org/v1/tree/4d6d8825a6bb689d459628312889dfbb0bcd41b5211d9e1ce768b0ff0309e562
+1
+KgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+
+— sigsum.org/v1/tree/4d6d8825a6bb689d459628312889dfbb0bcd41b5211d9e1ce768b0ff0309e562 UgIom7fPZTqpxWWhyjWduBvTvGVqsokMbqTArsQilegKoFBJQjUFAmQ0+YeSPM3wfUQMFSzVnnNuWRTYrajXpNUbIQY=
+`))
+			if _, ok := err.(*conflictError); err != nil && !ok {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if _, _, err := w.getLog(origin); err != nil {
+				t.Errorf("getLog: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	size, _, err := w.getLog(origin)
+	fatalIfErr(t, err)
+	if size != 1 {
+		t.Errorf("got size %d, want 1", size)
+	}
+}
+
+func TestPinnedFirstCheckpoint(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		size    int64
+		hash    string
+		wantErr error
+	}{
+		{"match", 1, "KgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", nil},
+		{"wrong hash", 1, "KgEAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", errProof},
+		{"wrong size", 3, "KgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", errProof},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ss := ed25519.PrivateKey(mustDecodeHex(t,
+				"31ffc2116ecbe003acaa800ab70757bd7d53206e3febef6a6d0796d95530b34f"+
+					"64848ad8abed6e85981b3b3875b252b8767ebb4b02f703aca3b1e71bbd6a8e50"))
+			w, err := NewWitness(":memory:", "example.com", ss, Policy{}, slog.New(testLogHandler(t)))
+			fatalIfErr(t, err)
+			t.Cleanup(func() { w.Close() })
+			pk := mustDecodeHex(t, "ffdc2d4d98e4124d3feaf788c0c2f9abfd796083d1f0495437f302ec79cf100f")
+			origin := "sigsum.org/v1/tree/4d6d8825a6bb689d459628312889dfbb0bcd41b5211d9e1ce768b0ff0309e562"
+
+			treeHash := merkle.HashEmptyTree()
+			fatalIfErr(t, sqlitex.Exec(w.db, "INSERT INTO log (origin, tree_size, tree_hash, pinned_size, pinned_hash) VALUES (?, 0, ?, ?, ?)",
+				nil, origin, base64.StdEncoding.EncodeToString(treeHash[:]), tt.size, tt.hash))
+			k, err := note.NewEd25519VerifierKey(origin, pk[:])
+			fatalIfErr(t, err)
+			fatalIfErr(t, sqlitex.Exec(w.db, "INSERT INTO key (origin, key) VALUES (?, ?)", nil, origin, k))
+
+			_, _, err = w.processAddCheckpointRequest([]byte(`old 0
+
+sigsum.org/v1/tree/4d6d8825a6bb689d459628312889dfbb0bcd41b5211d9e1ce768b0ff0309e562
+1
+KgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+
+— sigsum.org/v1/tree/4d6d8825a6bb689d459628312889dfbb0bcd41b5211d9e1ce768b0ff0309e562 UgIom7fPZTqpxWWhyjWduBvTvGVqsokMbqTArsQilegKoFBJQjUFAmQ0+YeSPM3wfUQMFSzVnnNuWRTYrajXpNUbIQY=
+`))
+			if err != tt.wantErr {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyCache(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "witness.db")
+	ss := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	w, err := NewWitness(dbPath, "example.com", ss, Policy{}, slog.New(testLogHandler(t)))
+	fatalIfErr(t, err)
+	t.Cleanup(func() { w.Close() })
+
+	// Simulate witnessctl modifying the database from another connection.
+	db, err := OpenDB(context.Background(), dbPath)
+	fatalIfErr(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	origin := "example.com/log"
+	treeHash := merkle.HashEmptyTree()
+	fatalIfErr(t, sqlitex.Exec(db, "INSERT INTO log (origin, tree_size, tree_hash) VALUES (?, 0, ?)",
+		nil, origin, base64.StdEncoding.EncodeToString(treeHash[:])))
+	k1, err := note.NewEd25519VerifierKey(origin, make([]byte, ed25519.PublicKeySize))
+	fatalIfErr(t, err)
+	fatalIfErr(t, sqlitex.Exec(db, "INSERT INTO key (origin, key) VALUES (?, ?)", nil, origin, k1))
+
+	v1, err := w.getKeys(origin)
+	fatalIfErr(t, err)
+	if _, err := v1.Verifier(origin, mustKeyHash(t, k1)); err != nil {
+		t.Errorf("first key not found: %v", err)
+	}
+	if _, ok := w.keys[origin]; !ok {
+		t.Errorf("keys were not cached")
+	}
+
+	k2, err := note.NewEd25519VerifierKey(origin, bytes.Repeat([]byte{1}, ed25519.PublicKeySize))
+	fatalIfErr(t, err)
+	fatalIfErr(t, sqlitex.Exec(db, "UPDATE key SET key = ? WHERE origin = ?", nil, k2, origin))
+
+	v2, err := w.getKeys(origin)
+	fatalIfErr(t, err)
+	if _, err := v2.Verifier(origin, mustKeyHash(t, k2)); err != nil {
+		t.Errorf("cache not invalidated, new key not found: %v", err)
+	}
+	if _, err := v2.Verifier(origin, mustKeyHash(t, k1)); err == nil {
+		t.Errorf("cache not invalidated, old key still found")
+	}
+}
+
+func TestLearnPolicy(t *testing.T) {
+	ss := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	pk := mustDecodeHex(t, "ffdc2d4d98e4124d3feaf788c0c2f9abfd796083d1f0495437f302ec79cf100f")
+	origin := "sigsum.org/v1/tree/4d6d8825a6bb689d459628312889dfbb0bcd41b5211d9e1ce768b0ff0309e562"
+	k, err := note.NewEd25519VerifierKey(origin, pk[:])
+	fatalIfErr(t, err)
+	other, err := note.NewEd25519VerifierKey(origin, make([]byte, ed25519.PublicKeySize))
+	fatalIfErr(t, err)
+	req := []byte(`old 0
+
+sigsum.org/v1/tree/4d6d8825a6bb689d459628312889dfbb0bcd41b5211d9e1ce768b0ff0309e562
+1
+KgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+
+— sigsum.org/v1/tree/4d6d8825a6bb689d459628312889dfbb0bcd41b5211d9e1ce768b0ff0309e562 UgIom7fPZTqpxWWhyjWduBvTvGVqsokMbqTArsQilegKoFBJQjUFAmQ0+YeSPM3wfUQMFSzVnnNuWRTYrajXpNUbIQY=
+`)
+
+	newWitness := func(p Policy) *Witness {
+		w, err := NewWitness(":memory:", "example.com", ss, p, slog.New(testLogHandler(t)))
+		fatalIfErr(t, err)
+		t.Cleanup(func() { w.Close() })
+		return w
+	}
+
+	// The strict policy rejects unknown logs.
+	w := newWitness(Policy{})
+	if _, _, err := w.processAddCheckpointRequest(req); err != errUnknownLog {
+		t.Errorf("got error %v, want %v", err, errUnknownLog)
+	}
+
+	// A checkpoint not signed by a learn key doesn't add the log.
+	w = newWitness(Policy{LearnKeys: []string{other}})
+	if _, _, err := w.processAddCheckpointRequest(req); err != errInvalidSignature {
+		t.Errorf("got error %v, want %v", err, errInvalidSignature)
+	}
+	if _, _, err := w.getLog(origin); err != errUnknownLog {
+		t.Errorf("log was added after an invalid signature: %v", err)
+	}
+
+	// Neither does a validly signed but malformed checkpoint.
+	skey, vkey, err := note.GenerateKey(nil, origin)
+	fatalIfErr(t, err)
+	signer, err := note.NewSigner(skey)
+	fatalIfErr(t, err)
+	malformed, err := note.Sign(&note.Note{Text: origin + "\nnot a size\n"}, signer)
+	fatalIfErr(t, err)
+	w = newWitness(Policy{LearnKeys: []string{vkey}})
+	if _, _, err := w.processAddCheckpointRequest(append([]byte("old 0\n\n"), malformed...)); err == nil {
+		t.Errorf("expected an error for a malformed checkpoint")
+	}
+	if _, _, err := w.getLog(origin); err != errUnknownLog {
+		t.Errorf("log was added after a malformed checkpoint: %v", err)
+	}
+
+	w = newWitness(Policy{LearnKeys: []string{other, k}})
+	_, _, err = w.processAddCheckpointRequest(req)
+	fatalIfErr(t, err)
+	if size, _, err := w.getLog(origin); err != nil || size != 1 {
+		t.Errorf("got size %d and error %v, want 1", size, err)
+	}
+	var keys []string
+	fatalIfErr(t, sqlitex.Exec(w.db, "SELECT key FROM key WHERE origin = ?", func(stmt *sqlite.Stmt) error {
+		keys = append(keys, stmt.GetText("key"))
+		return nil
+	}, origin))
+	if !slices.Equal(keys, []string{other, k}) {
+		t.Errorf("got keys %q, want %q", keys, []string{other, k})
+	}
+	// Once learned, the log is handled like any other.
+	if _, _, err := w.processAddCheckpointRequest(req); err == nil {
+		t.Errorf("expected a conflict for a repeated first checkpoint")
+	}
+
+	if _, err := NewWitness(":memory:", "example.com", ss,
+		Policy{LearnKeys: []string{"invalid"}}, slog.New(testLogHandler(t))); err == nil {
+		t.Errorf("expected an error for an invalid learn key")
+	}
+}
+
+func mustKeyHash(t *testing.T, vkey string) uint32 {
+	v, err := note.NewVerifier(vkey)
+	fatalIfErr(t, err)
+	return v.KeyHash()
+}
+
+func TestMaxBody(t *testing.T) {
+	ss := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	w, err := NewWitness(":memory:", "example.com", ss, Policy{}, slog.New(testLogHandler(t)))
+	fatalIfErr(t, err)
+	t.Cleanup(func() { w.Close() })
+
+	h := http.MaxBytesHandler(w, 100)
+	req := httptest.NewRequest("POST", "/add-checkpoint", strings.NewReader(strings.Repeat("A", 101)))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	ss := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	buf := &bytes.Buffer{}
+	l := slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	w, err := NewWitness(":memory:", "example.com", ss, Policy{}, l)
+	fatalIfErr(t, err)
+	t.Cleanup(func() { w.Close() })
+
+	body := "old 0\n\nexample.com/unknown\n5\nsecret\n\n— example.com/unknown AAAA\n"
+	req := httptest.NewRequest("POST", "/add-checkpoint", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	w.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	got := buf.String()
+	for _, want := range []string{"level=INFO", "msg=add-checkpoint", "method=POST",
+		"origin=example.com/unknown", "code=404", "latency="} {
+		if !strings.Contains(got, want) {
+			t.Errorf("access log %q doesn't contain %q", got, want)
+		}
+	}
+	if strings.Contains(got, "secret") {
+		t.Errorf("access log %q contains the request body", got)
+	}
 }
 
 func testLogHandler(t testing.TB) slog.Handler {